@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"locals3"
 	"oneke"
 	"company/tf"
-	"strings"
+	"reconcile"
+	"os"
+	"statestore"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -15,165 +19,266 @@ import (
 
 var handlerWrapper sfxlambda.HandlerWrapper
 
-func handler(ctx context.Context, s3Event events.S3Event) {
+// onekeClients holds a client per 1ke API version, shared across invocations so a warm container reuses
+// its connections to 1ke
+var onekeClients map[oneke.APIVersion]*oneke.Client
+
+var cfg config
+
+// reconcileEvent is the S3 notification, plus a flag so a single invocation can be made a dry run when
+// testing against a real bucket
+type reconcileEvent struct {
+	events.S3Event
+	DryRun bool `json:"dryRun"`
+}
+
+func handler(ctx context.Context, s3Event reconcileEvent) {
+
+	// in a dry run everything is planned as normal, but oneke won't send anything that would change 1ke
+	dryRun := cfg.dryRun || s3Event.DryRun
+	if dryRun {
+		fmt.Printf("Dry run - no tests, labels or alert rules will be changed in 1ke\n")
+		ctx = oneke.WithDryRun(ctx)
+	}
+
+	// agents are only listed once per invocation, however many stacks and templates need them
+	agentResolvers := make(map[oneke.APIVersion]*oneke.AgentResolver)
+
+	// labels and alert rules are cached on the clients, which outlive the invocation, so start afresh in case they've been edited in 1ke
+	for _, onekeClient := range onekeClients {
+		onekeClient.ResetCaches()
+	}
 
 	for _, record := range s3Event.Records {
-		s3record := record.S3
-		fmt.Printf("[%s - %s] Bucket: %s - Key: %s - Event_type: %s \n", record.EventSource, record.EventTime, s3record.Bucket.Name, s3record.Object.Key, record.EventName)
+		// keys arrive URL encoded, so let's decode them before anything else looks at them
+		ref, err := locals3.NewStateObjectRef(record)
+		if err != nil {
+			fmt.Printf("[%s - %s] %v - Event_type: %s, skipping\n", record.EventSource, record.EventTime, err, record.EventName)
+			continue
+		}
+		fmt.Printf("[%s - %s] Bucket: %s - Key: %s - Version: %s - Sequencer: %s - Event_type: %s \n", record.EventSource, record.EventTime, ref.Bucket, ref.Key, ref.VersionID, ref.Sequencer, ref.EventName)
 
 		//locals3.DetermineObject(record.EventName)
 
+		var sum *summary
+
 		// let's determine whether this is a put or delete operation and act accordingly
-		switch record.EventName {
+		switch ref.EventName {
 
-		case "ObjectRemoved:Delete":
-			// If it's a delete op we need to take stack details from the notifcation and remove tests from 1ke. This is redundant for now.
+		case "ObjectRemoved:Delete", "ObjectRemoved:DeleteMarkerCreated":
+			// If it's a delete op the state has gone and the stack with it, so its tests should go too. A delete marker in a
+			// versioned bucket counts, but only if nothing newer has been written since the notification was sent
 			fmt.Println("Delete operation detected")
 
+			stateKey, ok := cfg.keyLayout.Match(ref.Key)
+			if !ok {
+				fmt.Printf("Key %v doesn't match the key layout %v, skipping\n", ref.Key, cfg.keyLayout)
+				break
+			}
+			stack := stateKey.Stack
+
+			gone, err := locals3.ObjectGone(ref.Bucket, ref.Key)
+			if err != nil {
+				fmt.Printf("%v, leaving the tests for %v alone\n", err, stack)
+				break
+			}
+			if !gone {
+				fmt.Printf("A newer state for %v has been written since, leaving its tests alone\n", stack)
+				break
+			}
+
+			fmt.Printf("State for %v has been removed, deleting any existing tests\n", stack)
+			sum = newSummary(stack, dryRun)
+
+			// leave a tombstone once the tests are gone, so a late notification for an old version of the state can't bring them back
+			if reconcileStack(ctx, onekeClients[cfg.apiVersionFor(stack)], sum, stack, nil) && len(sum.failures) == 0 && !dryRun {
+				saveTombstone(ctx, stack, ref)
+			}
+
 		case "ObjectCreated:Put":
 			// If it's a put operation we need to determine whether 1ke has the test
 			fmt.Println("Put operation detected")
 
-			//Let's gather the file contents ready to parse
+			stateKey, ok := cfg.keyLayout.Match(ref.Key)
+			if !ok {
+				fmt.Printf("Key %v doesn't match the key layout %v, skipping\n", ref.Key, cfg.keyLayout)
+				break
+			}
+			stack := stateKey.Stack
+
+			//Let's gather the file contents ready to parse, the version the notification was about if the bucket is versioned
 
-			var tfStateData string = locals3.GetObject(s3record.Bucket.Name, s3record.Object.Key)
-			s := strings.Split(s3record.Object.Key, "/")
-			fmt.Printf("Stack name: %v\n", s[2])
-			stack := s[2]
+			tfStateData, err := locals3.GetObjectVersion(ref.Bucket, ref.Key, ref.VersionID)
+			if err != nil {
+				// most likely the version has been deleted or expired since, either way there's nothing to apply
+				fmt.Printf("%v, skipping\n", err)
+				continue
+			}
+			fmt.Printf("Stack name: %v - Env: %v - Region: %v\n", stack, stateKey.Env, stateKey.Region)
+
+			// notifications can turn up late, twice or out of order, so let's make sure this state is newer than the last one we applied
+			state, err := tf.ParseState(tfStateData)
+			if err != nil {
+				fmt.Printf("%v, skipping\n", err)
+				break
+			}
+			record := statestore.Record{Stack: stack, Key: ref.Key, Serial: state.Serial, Lineage: state.Lineage, Sequencer: ref.Sequencer}
+			if !newerState(ctx, record) {
+				break
+			}
+			sum = newSummary(stack, dryRun)
+			onekeClient := onekeClients[cfg.apiVersionFor(stack)]
+			agentResolver, ok := agentResolvers[cfg.apiVersionFor(stack)]
+			if !ok {
+				agentResolver = oneke.NewAgentResolver(onekeClient)
+				agentResolvers[cfg.apiVersionFor(stack)] = agentResolver
+			}
+			fmt.Printf("Using 1ke API %v for stack %v\n", cfg.apiVersionFor(stack), stack)
 
 			// Let's send this off to a terraform parse routine, we'll get back a map of tests to check (and possibly create)
 
 			testData := tf.ParseJSON(tfStateData)
 
-			// If we have no resources in our TF, then the TF state is empty, it means this is a stack delete
+			// If we have no resources in our TF, then the TF state is empty, it means this is a stack delete. If no search heads
+			// have been found we can't determine the instance type (we aren't creating tests for single instances or IDM's at present,
+			// this may change in future), and if whitelisting has been found 1ke can't reach the stack. Either way the stack wants no
+			// tests, so any that were there get mopped up
 
-			if len(testData) == 1 && testData["DELETE"] == "YES" {
+			var desired []reconcile.DesiredTest
+			switch {
+			case len(testData) == 1 && testData["DELETE"] == "YES":
 				fmt.Printf("We have instructions to delete any existing tests\n")
-				stackTestData := oneke.GatherTestsForStack(stack)
-				if len(stackTestData) == 0 {
-					fmt.Printf("No existing tests found for %v, exiting\n", stack)
-					break
-				}
-				deleteCounter := 0
-				for url := range stackTestData {
-					fmt.Printf("Delete test: %v - Type: %v - ID: %v", url, stackTestData[url]["testType"], stackTestData[url]["testID"])
-					oneke.DeleteTest(stackTestData[url]["testType"].(string), stackTestData[url]["testID"].(int))
-					deleteCounter++
-				}
-
-				/*dp := datapoint.Datapoint{
-					Metric:     "db_calls",
-					Value:      datapoint.NewIntValue(1),
-					MetricType: datapoint.Counter,
-					Dimensions: map[string]string{"db_name": "mysql1"},
-				}
-				handlerWrapper.SendDatapoints([]*datapoint.Datapoint{&dp})*/
-				break
+			case len(testData) == 1 && testData["SEARCH_HEADS"] == "NONE_FOUND":
+				fmt.Printf("No search heads found, unable to determine instance type, let's cleanup any existing tests...\n")
+			case len(testData) == 1 && testData["WHITELISTING"] == "FOUND":
+				fmt.Printf("whitelisting found, checking for existing tests and if found, deleting...\n")
+			default:
+				desired = desiredTests(ctx, onekeClient, agentResolver, sum, stateKey, testData)
 			}
 
-			// If no search heads have been found, we'll move on. We aren't creating tests for single instances or IDM's at present (this may change in future)
-
-			if len(testData) == 1 && testData["SEARCH_HEADS"] == "NONE_FOUND" {
-				fmt.Printf("No search heads found, unable to determine instance type, let's cleanup any existing tests and exiting...\n")
-				stackTestData := oneke.GatherTestsForStack(stack)
-				if len(stackTestData) == 0 {
-					fmt.Printf("No existing tests found for %v, exiting\n", stack)
-					break
-				}
-				for url := range stackTestData {
-					fmt.Printf("Delete test: %v - Type: %v - ID: %v", url, stackTestData[url]["testType"], stackTestData[url]["testID"])
-					oneke.DeleteTest(stackTestData[url]["testType"].(string), stackTestData[url]["testID"].(int))
-				}
-				break
+			// only remember the state once it's fully applied, so a failure gets another go when the notification is retried
+			if reconcileStack(ctx, onekeClient, sum, stack, desired) && len(sum.failures) == 0 && !dryRun {
+				saveState(ctx, record)
 			}
 
-			// If whitelisting has been found, we should delete any tests that were previously there
+		}
 
-			if len(testData) == 1 && testData["WHITELISTING"] == "FOUND" {
-				fmt.Printf("whitelisting found, checking for existing tests and if found, deleting...\n")
-				stackTestData := oneke.GatherTestsForStack(stack)
-				if len(stackTestData) == 0 {
-					fmt.Printf("No existing tests found for %v, exiting\n", stack)
-					break
-				}
-				for url := range stackTestData {
-					fmt.Printf("Delete test: %v - Type: %v - ID: %v", url, stackTestData[url]["testType"], stackTestData[url]["testID"])
-					oneke.DeleteTest(stackTestData[url]["testType"].(string), stackTestData[url]["testID"].(int))
-				}
-				break
-			}
+		if sum != nil {
+			sum.print()
+		}
 
-			// If we're here, the stack mathces our criteria for adding/deleting tests, let's get a list of tests from 1ke
-
-			onekeTests := oneke.GatherAllTests()
-
-			// We need to gather all tests for this particular stack as we need to also remove tests that are no longr required after we have checked on the tests that should be
-			// there as reported by TFState
-
-			stackTestData := oneke.GatherTestsForStack(stack)
-
-			// We now have a map of 1ketests and a map of tests needed - let's check to see if the tests exist, if they do let's
-			// leave as-is (if we deleted there would be a small outage as the 1ke tests don't come onboard for a few minutes), if they don't just create
-
-			for testString, id := range testData {
-
-				// testString looks like this 1ke-test~aqueduct-1ke-test.companyworks.lol
-
-				s := strings.Split(testString, "~")
-				//fmt.Printf("Stack name: %v\n", s[0])
-				//stack := s[0]
-				keyToCheckFor := "https://" + s[1] + "/en-US/account/login?loginType=company"
-
-				fmt.Printf("Checking for existence of test: - %v\n", keyToCheckFor)
-				if _, ok := onekeTests[keyToCheckFor]; ok {
-					fmt.Printf("Test has been found: - %v - ID: %v - Test Type: %v - Test ID: %v - Test Name: %v\n", keyToCheckFor, id, onekeTests[keyToCheckFor]["testType"], onekeTests[keyToCheckFor]["testID"], onekeTests[keyToCheckFor]["testName"])
-					_, ok := stackTestData[keyToCheckFor]
-					if ok {
-						delete(stackTestData, keyToCheckFor)
-					}
-				} else {
-					if strings.Contains(testString, "stg.companycloud.com") || strings.Contains(testString, "companyworks.lol") {
-						fmt.Printf("No test found but stg or dev environment detected, not actually creating test for %v\n", keyToCheckFor)
-						//oneke.CreateTest(stack, "http-server", keyToCheckFor, id)
-						_, ok := stackTestData[keyToCheckFor]
-						if ok {
-							delete(stackTestData, keyToCheckFor)
-						}
-					} else {
-						fmt.Printf("No test found: %v - ID %v - Creating test at 1ke\n", keyToCheckFor, id)
-						// We need to call our create 1ke test routine
-						oneke.CreateTest(stack, "http-server", keyToCheckFor, id)
-						_, ok := stackTestData[keyToCheckFor]
-						if ok {
-							delete(stackTestData, keyToCheckFor)
-						}
-					}
-
-				}
+	}
 
-			}
+}
 
-			// We should now have created the tests from the info provided by TF, let's do a final sweep of the tests that were there to see if we need to mop up
+// newerState checks a state just read against the last one applied for its stack, true when it should be
+// applied
+func newerState(ctx context.Context, next statestore.Record) bool {
 
-			if len(stackTestData) == 0 {
-				fmt.Printf("No leftover tests, we appear to be in sync with TFstate\n")
-			} else {
-				fmt.Printf("We have leftover tests - these should be deleted to ensure we're in sync with TFstate\n")
-				for url := range stackTestData {
-					fmt.Printf("Test: %v - Type: %v - ID: %v\n", url, stackTestData[url]["testType"], stackTestData[url]["testID"])
-					oneke.DeleteTest(stackTestData[url]["testType"].(string), stackTestData[url]["testID"].(int))
-				}
-			}
+	if cfg.stateStore == nil {
+		return true
+	}
 
-		}
+	last, found, err := cfg.stateStore.Last(ctx, next.Stack)
+	if err != nil {
+		// better to wait for the next notification than risk rolling the stack's tests back
+		fmt.Printf("Unable to check the last state applied for %v - %v, skipping\n", next.Stack, err)
+		return false
+	}
+
+	apply, reason := statestore.Check(last, found, next)
+	if !apply {
+		fmt.Printf("Skipping state for %v - %v\n", next.Stack, reason)
+		return false
+	}
+	fmt.Printf("Applying state for %v - %v\n", next.Stack, reason)
+	return true
+}
+
+// saveState records a state as the last one applied for its stack
+func saveState(ctx context.Context, record statestore.Record) {
+
+	if cfg.stateStore == nil {
+		return
+	}
+
+	record.AppliedAt = time.Now()
+	err := cfg.stateStore.Save(ctx, record)
+	switch {
+	case errors.Is(err, statestore.ErrStale):
+		fmt.Printf("A newer state for %v was applied while we were working, not recording serial %v\n", record.Stack, record.Serial)
+	case err != nil:
+		fmt.Printf("Unable to record serial %v for %v - %v\n", record.Serial, record.Stack, err)
+	}
+}
+
+// saveTombstone records that stack's state was removed, keeping the serial and lineage it had
+func saveTombstone(ctx context.Context, stack string, ref locals3.StateObjectRef) {
 
+	if cfg.stateStore == nil {
+		return
 	}
 
+	last, _, err := cfg.stateStore.Last(ctx, stack)
+	if err != nil {
+		fmt.Printf("Unable to record the removal of %v - %v\n", stack, err)
+		return
+	}
+
+	saveState(ctx, statestore.Record{Stack: stack, Key: ref.Key, Serial: last.Serial, Lineage: last.Lineage, Sequencer: ref.Sequencer, Deleted: true})
+}
+
+// reconcileStack brings the stack's tests in 1ke in line with desired, nil desired removes them all. It's
+// false if we couldn't get as far as applying a plan.
+func reconcileStack(ctx context.Context, onekeClient *oneke.Client, sum *summary, stack string, desired []reconcile.DesiredTest) bool {
+
+	// Let's get a list of tests from 1ke, the whole account so a test someone else made for the same thing stops us creating a
+	// duplicate, with the stack's own marked so anything no longer required gets removed
+
+	onekeTests, err := onekeClient.GatherAllTests(ctx)
+	if err != nil {
+		fmt.Printf("Unable to gather tests from 1ke - %v\n", err)
+		return false
+	}
+	actual := onekeTests.WithOwnership(stack, cfg.ownership)
+
+	// the tests we might update need their full details to see if they've drifted
+	if err := onekeClient.LoadDetails(ctx, actual, reconcile.NeedsDetails(desired, actual)); err != nil {
+		fmt.Printf("Unable to load test details from 1ke - %v\n", err)
+		return false
+	}
+
+	// We now have the tests needed and the tests there, let's work out what to create, update in place (if we deleted
+	// there would be a small outage as the 1ke tests don't come onboard for a few minutes) and delete, then do it
+
+	plan := reconcile.Plan(desired, actual)
+	fmt.Print(plan)
+	if !plan.Changes() {
+		fmt.Printf("Nothing to change, we appear to be in sync with TFstate\n")
+	}
+
+	for _, result := range reconcile.Apply(ctx, plan, onekeClient) {
+		sum.record(result)
+	}
+
+	return true
 }
 
 func main() {
 	// Make the handler available for Remote Procedure Call by AWS Lambda
 
+	var err error
+	cfg, err = loadConfig()
+	if err != nil {
+		fmt.Printf("Unable to load config - %v\n", err)
+		os.Exit(2)
+	}
+
+	onekeClients = map[oneke.APIVersion]*oneke.Client{
+		oneke.V6: oneke.NewClient(cfg.clientOptions(oneke.V6)...),
+		oneke.V7: oneke.NewClient(cfg.clientOptions(oneke.V7)...),
+	}
+
 	handlerWrapper := sfxlambda.NewHandlerWrapper(lambda.NewHandler(handler))
 	sfxlambda.Start(handlerWrapper)
 
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"locals3"
+	"oneke"
+	"os"
+	"statestore"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is everything the reconciler reads from its environment at cold start
+type config struct {
+	// apiVersion is the 1ke API version used for stacks without an override (ONEKE_API_VERSION)
+	apiVersion oneke.APIVersion
+	// stackAPIVersions lets us move stacks over to a new API version one at a time
+	// (ONEKE_STACK_API_VERSIONS="stack1=v7,stack2=v7")
+	stackAPIVersions map[string]oneke.APIVersion
+	// authMode overrides how we authenticate to 1ke, "basic" or "bearer" (ONEKE_AUTH_MODE). Left empty each
+	// API version uses its own default.
+	authMode oneke.AuthMode
+	// credentials is shared by every client so we only go to Secrets Manager once, see credentialsFromEnv
+	credentials oneke.CredentialsProvider
+	// templates decides what each stack's tests look like (ONEKE_TEMPLATES_FILE, a JSON TemplateConfig).
+	// Without the file we get the one standard template we've always used.
+	templates *oneke.TemplateConfig
+	// ownership decides which tests in 1ke are a stack's (ONEKE_OWNERSHIP_FILE, JSON OwnershipRules). Without
+	// the file only tests with names we built or our stack labels count.
+	ownership *oneke.OwnershipRules
+	// dryRun plans every stack as normal but doesn't change anything in 1ke, just logs what it would have
+	// done (ONEKE_DRY_RUN=true). A single event can ask for a dry run with "dryRun": true too.
+	dryRun bool
+	// stateStore remembers the serial of the last state applied for each stack so late, repeated or out of
+	// order notifications are skipped, see stateStoreFromEnv. nil when there isn't one.
+	stateStore statestore.Store
+	// keyLayout is where the stack, env and region are in a state key (ONEKE_STATE_KEY_LAYOUT, a {name}
+	// template or regular expression with named groups, locals3.DefaultKeyLayout by default). Keys that don't
+	// match are skipped.
+	keyLayout *locals3.KeyLayout
+}
+
+func loadConfig() (config, error) {
+
+	cfg := config{stackAPIVersions: make(map[string]oneke.APIVersion)}
+
+	version, err := oneke.ParseAPIVersion(os.Getenv("ONEKE_API_VERSION"))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.apiVersion = version
+
+	for _, pair := range strings.Split(os.Getenv("ONEKE_STACK_API_VERSIONS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		s := strings.SplitN(pair, "=", 2)
+		if len(s) != 2 {
+			return cfg, fmt.Errorf("ONEKE_STACK_API_VERSIONS entry %q should look like stack=version", pair)
+		}
+		version, err := oneke.ParseAPIVersion(strings.TrimSpace(s[1]))
+		if err != nil {
+			return cfg, err
+		}
+		cfg.stackAPIVersions[strings.TrimSpace(s[0])] = version
+	}
+
+	cfg.authMode, err = oneke.ParseAuthMode(os.Getenv("ONEKE_AUTH_MODE"))
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.credentials, err = credentialsFromEnv()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.templates = oneke.DefaultTemplateConfig()
+	if path := os.Getenv("ONEKE_TEMPLATES_FILE"); path != "" {
+		cfg.templates, err = oneke.LoadTemplateConfig(path)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := cfg.checkTemplateAPIVersions(); err != nil {
+		return cfg, err
+	}
+
+	cfg.ownership = oneke.DefaultOwnershipRules()
+	if path := os.Getenv("ONEKE_OWNERSHIP_FILE"); path != "" {
+		cfg.ownership, err = oneke.LoadOwnershipRules(path)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	if s := os.Getenv("ONEKE_DRY_RUN"); s != "" {
+		cfg.dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			return cfg, fmt.Errorf("ONEKE_DRY_RUN: %v", err)
+		}
+	}
+
+	cfg.stateStore, err = stateStoreFromEnv()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.keyLayout, err = locals3.ParseKeyLayout(getenvDefault("ONEKE_STATE_KEY_LAYOUT", locals3.DefaultKeyLayout))
+	if err != nil {
+		return cfg, fmt.Errorf("ONEKE_STATE_KEY_LAYOUT: %v", err)
+	}
+	if !cfg.keyLayout.Has("region") && cfg.templates.UsesStackRegion() {
+		return cfg, fmt.Errorf("ONEKE_STATE_KEY_LAYOUT: templates pick agents with region=stack but key layout %v has no region in it", cfg.keyLayout)
+	}
+
+	return cfg, nil
+}
+
+// stateStoreFromEnv builds the store of applied state serials. ONEKE_STATE_STORE picks where it lives:
+//
+//	none (default) - every notification is applied
+//	file           - JSON file at ONEKE_STATE_STORE_FILE (/tmp/1ke-state-serials.json by default)
+//	dynamodb       - ONEKE_STATE_STORE_TABLE in ONEKE_STATE_STORE_REGION (AWS_REGION by default),
+//	                 ONEKE_STATE_STORE_ENDPOINT for anything DynamoDB compatible
+func stateStoreFromEnv() (statestore.Store, error) {
+
+	switch source := os.Getenv("ONEKE_STATE_STORE"); source {
+	case "", "none":
+		return nil, nil
+	case "file":
+		return statestore.NewFileStore(getenvDefault("ONEKE_STATE_STORE_FILE", "/tmp/1ke-state-serials.json")), nil
+	case "dynamodb":
+		table := os.Getenv("ONEKE_STATE_STORE_TABLE")
+		if table == "" {
+			return nil, fmt.Errorf("ONEKE_STATE_STORE_TABLE must be set when ONEKE_STATE_STORE is dynamodb")
+		}
+		store := statestore.NewDynamoDBStore(table, getenvDefault("ONEKE_STATE_STORE_REGION", os.Getenv("AWS_REGION")))
+		store.Endpoint = os.Getenv("ONEKE_STATE_STORE_ENDPOINT")
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown ONEKE_STATE_STORE %q", source)
+	}
+}
+
+// credentialsFromEnv builds the credentials provider. ONEKE_CREDENTIALS_SOURCE picks where they come from:
+//
+//	secretsmanager (default) - ONEKE_SECRET_ID, ONEKE_SECRET_REGION, ONEKE_SECRET_VERSION_STAGE and
+//	                           ONEKE_SECRET_{USER,TOKEN,BEARER_TOKEN,ACCOUNT_GROUP}_FIELD
+//	env                      - ONEKE_USER, ONEKE_TOKEN, ONEKE_BEARER_TOKEN, ONEKE_ACCOUNT_GROUP_ID
+//	file                     - JSON file at ONEKE_CREDENTIALS_FILE
+//
+// Whatever the source, it's cached for ONEKE_CREDENTIALS_TTL (a Go duration, 15m by default).
+func credentialsFromEnv() (oneke.CredentialsProvider, error) {
+
+	var provider oneke.CredentialsProvider
+
+	switch source := os.Getenv("ONEKE_CREDENTIALS_SOURCE"); source {
+	case "", "secretsmanager":
+		sm := oneke.NewSecretsManagerProvider(getenvDefault("ONEKE_SECRET_ID", oneke.DefaultSecretID), getenvDefault("ONEKE_SECRET_REGION", oneke.DefaultSecretRegion))
+		sm.VersionStage = getenvDefault("ONEKE_SECRET_VERSION_STAGE", sm.VersionStage)
+		sm.UserField = os.Getenv("ONEKE_SECRET_USER_FIELD")
+		sm.TokenField = os.Getenv("ONEKE_SECRET_TOKEN_FIELD")
+		sm.BearerTokenField = os.Getenv("ONEKE_SECRET_BEARER_TOKEN_FIELD")
+		sm.AccountGroupField = os.Getenv("ONEKE_SECRET_ACCOUNT_GROUP_FIELD")
+		provider = sm
+	case "env":
+		provider = oneke.NewEnvProvider()
+	case "file":
+		path := os.Getenv("ONEKE_CREDENTIALS_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("ONEKE_CREDENTIALS_FILE must be set when ONEKE_CREDENTIALS_SOURCE is file")
+		}
+		provider = &oneke.FileProvider{Path: path}
+	default:
+		return nil, fmt.Errorf("unknown ONEKE_CREDENTIALS_SOURCE %q", source)
+	}
+
+	ttl := oneke.DefaultCredentialsTTL
+	if s := os.Getenv("ONEKE_CREDENTIALS_TTL"); s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("ONEKE_CREDENTIALS_TTL: %v", err)
+		}
+	}
+
+	return oneke.NewCachingProvider(provider, ttl), nil
+}
+
+func getenvDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// clientOptions returns the oneke options for a client talking the given API version
+func (cfg config) clientOptions(version oneke.APIVersion) []oneke.Option {
+	return []oneke.Option{
+		oneke.WithAPIVersion(version),
+		oneke.WithAuthMode(cfg.authMode),
+		oneke.WithCredentials(cfg.credentials),
+		oneke.WithOwnershipRules(cfg.ownership),
+	}
+}
+
+// apiVersionFor returns the 1ke API version a stack should be reconciled with
+func (cfg config) apiVersionFor(stack string) oneke.APIVersion {
+	if version, ok := cfg.stackAPIVersions[stack]; ok {
+		return version
+	}
+	return cfg.apiVersion
+}
+
+// checkTemplateAPIVersions makes sure no stack on the v6 API can be given an api template, v6 can't create
+// them so every one would fail at create time
+func (cfg config) checkTemplateAPIVersions() error {
+
+	tc := cfg.templates
+	check := func(what string, names oneke.TemplateNames) error {
+		for _, name := range names {
+			if tc.Templates[name].Type == oneke.TestTypeAPI {
+				return fmt.Errorf("template %q for %v is an api test, which needs the v7 API, but stacks it would go to are on v6", name, what)
+			}
+		}
+		return nil
+	}
+
+	for stack, names := range tc.Stacks {
+		if cfg.apiVersionFor(stack) == oneke.V6 {
+			if err := check("stack "+stack, names); err != nil {
+				return err
+			}
+		}
+	}
+
+	// stacks without an entry of their own get their tier's templates or the default, so those have to be
+	// fine on v6 too if any such stack is on it
+	v6 := cfg.apiVersion == oneke.V6
+	for stack, version := range cfg.stackAPIVersions {
+		if _, ok := tc.Stacks[stack]; !ok && version == oneke.V6 {
+			v6 = true
+		}
+	}
+	if !v6 {
+		return nil
+	}
+
+	for tier, names := range tc.Tiers {
+		if err := check("tier "+tier, names); err != nil {
+			return err
+		}
+	}
+	return check("default", tc.Default)
+}
+
+// tierFor works out which environment tier a stack is in. The test host's domain has always decided it and
+// still wins for stg and dev, so those stay read only whatever the key says. The env in the state key can
+// only move a stack out of prod, never into it.
+func tierFor(env string, host string) string {
+	switch {
+	case strings.Contains(host, "stg.companycloud.com"):
+		return "stg"
+	case strings.Contains(host, "companyworks.lol"):
+		return "dev"
+	}
+
+	switch strings.ToLower(env) {
+	case "stg", "stage", "staging":
+		return "stg"
+	case "dev", "development":
+		return "dev"
+	}
+	return "prod"
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"locals3"
+	"oneke"
+	"reconcile"
+	"sort"
+	"strings"
+)
+
+// desiredTests turns a stack's parsed terraform state into the tests it should have, one per template per
+// URL. Templates are resolved here (agents, alert rules, labels) so the planner doesn't need to talk to 1ke,
+// anything we can't resolve is recorded as a failure and marked so its existing test is left alone. The
+// env and region from the state key pick the tier and the agents near the stack.
+func desiredTests(ctx context.Context, onekeClient *oneke.Client, agentResolver *oneke.AgentResolver, sum *summary, stateKey locals3.StateKey, testData map[string]string) []reconcile.DesiredTest {
+
+	stack := stateKey.Stack
+	var desired []reconcile.DesiredTest
+
+	// in a fixed order so when two templates want the same test it's always the same one that gets it
+	testStrings := make([]string, 0, len(testData))
+	for testString := range testData {
+		testStrings = append(testStrings, testString)
+	}
+	sort.Strings(testStrings)
+
+	for _, testString := range testStrings {
+		id := testData[testString]
+
+		// testString looks like this 1ke-test~aqueduct-1ke-test.companyworks.lol
+
+		s := strings.Split(testString, "~")
+		testURL := "https://" + s[1] + "/en-US/account/login?loginType=company"
+
+		tier := tierFor(stateKey.Env, s[1])
+
+		// each template gives the URL a test of its own type
+		for _, tmpl := range cfg.templates.Select(stack, tier) {
+
+			d := reconcile.DesiredTest{
+				Stack:    stack,
+				Tier:     tier,
+				URL:      testURL,
+				ID:       id,
+				Template: tmpl,
+				// we don't create or change stg and dev tests for now
+				ReadOnly: tier != "prod",
+			}
+
+			d.Template, d.Problem = agentResolver.ResolveTemplate(ctx, d.Template, stateKey.Region)
+			if d.Problem == nil && !d.ReadOnly {
+				// prod tests get the tier's alert rules so they page, tiers without any stay quiet. This can
+				// create rules in 1ke so read only tiers don't get here, same as the labels below
+				d.Template, d.Problem = onekeClient.ApplyAlertRules(ctx, cfg.templates, d.Template, tier)
+			}
+			if d.Problem == nil {
+				// check the template now it's resolved, before the planner builds anything from it
+				d.Problem = d.Template.Validate()
+			}
+			if d.Problem != nil {
+				sum.recordCreate(d.Key(), d.Problem)
+				desired = append(desired, d)
+				continue
+			}
+
+			if !d.ReadOnly {
+				d.LabelIDs = onekeClient.LabelIDsFor(ctx, stack, tier)
+			}
+			fmt.Printf("Want test: %v - template %v - ID %v\n", d.Key(), tmpl.Name, id)
+			desired = append(desired, d)
+		}
+
+	}
+
+	return desired
+}
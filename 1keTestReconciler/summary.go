@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"oneke"
+	"reconcile"
+)
+
+// summary keeps track of what we asked 1ke to do for a single stack so we can report on it at the end,
+// rather than relying on the "Creating Test" lines that get printed whether or not it worked. In a dry run
+// it's what we would have done.
+type summary struct {
+	stack    string
+	dryRun   bool
+	created  []string
+	updated  []string
+	deleted  []string
+	failures []string
+}
+
+func newSummary(stack string, dryRun bool) *summary {
+	return &summary{stack: stack, dryRun: dryRun}
+}
+
+// record notes the outcome of one action from a plan
+func (s *summary) record(result reconcile.Result) {
+	action := result.Action
+	switch action.Kind {
+	case reconcile.Create:
+		s.recordCreate(action.Key, result.Err)
+	case reconcile.Update:
+		s.recordUpdate(action.Key, action.Diff, result.Err)
+	case reconcile.Delete:
+		s.recordDelete(action.Key, result.Err)
+	case reconcile.Conflict:
+		fmt.Printf("Conflicting templates for %v - %v\n", action.Key, action.Reason)
+		s.failures = append(s.failures, "conflict "+action.Key+": "+action.Reason)
+	}
+}
+
+// recordCreate notes the outcome of a CreateTest call
+func (s *summary) recordCreate(url string, err error) {
+	if err != nil {
+		fmt.Printf("Unable to create test %v - %v\n", url, err)
+		s.failures = append(s.failures, "create "+url+": "+describeError(err))
+		return
+	}
+	s.created = append(s.created, url)
+}
+
+// recordUpdate notes the outcome of an update, tests that were already in sync aren't counted
+func (s *summary) recordUpdate(url string, diff oneke.TestDiff, err error) {
+	if err != nil {
+		fmt.Printf("Unable to update test %v - %v\n", url, err)
+		s.failures = append(s.failures, "update "+url+": "+describeError(err))
+		return
+	}
+	if len(diff) > 0 {
+		s.updated = append(s.updated, url+" ("+diff.String()+")")
+	}
+}
+
+// recordDelete notes the outcome of a DeleteTest call
+func (s *summary) recordDelete(url string, err error) {
+	if err != nil {
+		fmt.Printf("Unable to delete test %v - %v\n", url, err)
+		s.failures = append(s.failures, "delete "+url+": "+describeError(err))
+		return
+	}
+	s.deleted = append(s.deleted, url)
+}
+
+func (s *summary) print() {
+	prefix := ""
+	if s.dryRun {
+		prefix = "Would have "
+	}
+	fmt.Printf("Summary for stack %v - Dry run: %v - Created: %v - Updated: %v - Deleted: %v - Failed: %v\n", s.stack, s.dryRun, len(s.created), len(s.updated), len(s.deleted), len(s.failures))
+	for _, url := range s.created {
+		fmt.Printf("%vCreated: %v\n", prefix, url)
+	}
+	for _, url := range s.updated {
+		fmt.Printf("%vUpdated: %v\n", prefix, url)
+	}
+	for _, url := range s.deleted {
+		fmt.Printf("%vDeleted: %v\n", prefix, url)
+	}
+	for _, failure := range s.failures {
+		fmt.Printf("Failed: %v\n", failure)
+	}
+}
+
+// describeError pulls the status and message out of a 1ke API error so the summary stays on one line
+func describeError(err error) string {
+	var apiErr *oneke.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("%d %v", apiErr.Status, apiErr.Message)
+	}
+	return err.Error()
+}
@@ -7,10 +7,22 @@ import (
 	"strings"
 )
 
-// Data comment
+// Data comment - Serial goes up each time terraform writes the state, Lineage is set once when the state is
+// first created
 type Data struct {
 	Resources []Resource `json:"resources"`
 	Version   string     `json:"terraform_version"`
+	Serial    int64      `json:"serial"`
+	Lineage   string     `json:"lineage"`
+}
+
+// ParseState unmarshals a whole state, for callers that need more than the tests ParseJSON picks out
+func ParseState(data string) (Data, error) {
+	var results Data
+	if err := json.Unmarshal([]byte(data), &results); err != nil {
+		return Data{}, fmt.Errorf("unable to parse TFstate - %w", err)
+	}
+	return results, nil
 }
 
 // Resource comment
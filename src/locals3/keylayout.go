@@ -0,0 +1,126 @@
+package locals3
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultKeyLayout is where state files live in the bucket - the stack is the third part of the key, same as
+// it always was, whatever comes after it
+const DefaultKeyLayout = "{env}/{region}/{stack}/**"
+
+// KeyLayout says how state keys are laid out, so the stack (and the environment and region, when the
+// layout has them) can be read back out of a key. It's either a template where each {name} stands for
+// one path segment, and a trailing /** matches whatever is left of the key (or nothing):
+//
+//	{env}/{region}/{stack}/terraform.tfstate
+//	{env}/{region}/{stack}/**
+//
+// or a regular expression with named groups, anything containing "(?P<" is taken as one:
+//
+//	^states/(?P<region>[a-z0-9-]+)/(?P<stack>[^/]+)\.tfstate$
+//
+// Either way it has to give us a stack.
+type KeyLayout struct {
+	source  string
+	pattern *regexp.Regexp
+}
+
+// StateKey is what a KeyLayout found in a key. Env and Region are empty when the layout doesn't have them,
+// Fields has every named part, those included.
+type StateKey struct {
+	Key    string
+	Env    string
+	Region string
+	Stack  string
+	Fields map[string]string
+}
+
+var placeholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ParseKeyLayout builds a KeyLayout from a template or regular expression
+func ParseKeyLayout(layout string) (*KeyLayout, error) {
+
+	expr := layout
+	if !strings.Contains(layout, "(?P<") {
+		expr = templateExpr(layout)
+	}
+
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse key layout %q - %w", layout, err)
+	}
+
+	l := &KeyLayout{source: layout, pattern: pattern}
+	if !l.Has("stack") {
+		return nil, fmt.Errorf("key layout %q has no stack in it", layout)
+	}
+
+	return l, nil
+}
+
+// templateExpr turns a {name} template into an anchored regular expression
+func templateExpr(template string) string {
+
+	var b strings.Builder
+	b.WriteString("^")
+
+	last := 0
+	for _, m := range placeholder.FindAllStringSubmatchIndex(template, -1) {
+		b.WriteString(regexp.QuoteMeta(template[last:m[0]]))
+		b.WriteString("(?P<" + template[m[2]:m[3]] + ">[^/]+)")
+		last = m[1]
+	}
+	rest := template[last:]
+	anything := strings.HasSuffix(rest, "/**")
+	if anything {
+		rest = strings.TrimSuffix(rest, "/**")
+	}
+	b.WriteString(regexp.QuoteMeta(rest))
+	if anything {
+		b.WriteString("(?:/.*)?")
+	}
+
+	b.WriteString("$")
+	return b.String()
+}
+
+// Match reads the stack, env and region out of key, false if the key isn't laid out the way we expect
+func (l *KeyLayout) Match(key string) (StateKey, bool) {
+
+	m := l.pattern.FindStringSubmatch(key)
+	if m == nil {
+		return StateKey{}, false
+	}
+
+	sk := StateKey{Key: key, Fields: make(map[string]string)}
+	for i, name := range l.pattern.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		sk.Fields[name] = m[i]
+	}
+	sk.Env = sk.Fields["env"]
+	sk.Region = sk.Fields["region"]
+	sk.Stack = sk.Fields["stack"]
+
+	if sk.Stack == "" {
+		return StateKey{}, false
+	}
+	return sk, true
+}
+
+// Has reports whether the layout gives us a name, Region is always empty for a layout without a region
+func (l *KeyLayout) Has(name string) bool {
+	for _, n := range l.pattern.SubexpNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *KeyLayout) String() string {
+	return l.source
+}
@@ -0,0 +1,49 @@
+package locals3
+
+import "testing"
+
+func TestDefaultKeyLayout(t *testing.T) {
+
+	layout, err := ParseKeyLayout(DefaultKeyLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key   string
+		stack string
+		ok    bool
+	}{
+		{"prod/us-west-2/abc/terraform.tfstate", "abc", true},
+		{"prod/us-west-2/abc/env:/blue/terraform.tfstate", "abc", true},
+		{"prod/us-west-2/abc", "abc", true},
+		{"prod/us-west-2/abc/", "abc", true},
+		{"prod/us-west-2", "", false},
+		{"prod//abc/terraform.tfstate", "", false},
+	}
+
+	for _, tt := range tests {
+		sk, ok := layout.Match(tt.key)
+		if ok != tt.ok || sk.Stack != tt.stack {
+			t.Errorf("Match(%q) = %q, %v, want %q, %v", tt.key, sk.Stack, ok, tt.stack, tt.ok)
+		}
+		if ok && (sk.Env != "prod" || sk.Region != "us-west-2") {
+			t.Errorf("Match(%q) env and region = %q, %q", tt.key, sk.Env, sk.Region)
+		}
+	}
+}
+
+func TestKeyLayoutHas(t *testing.T) {
+
+	layout, err := ParseKeyLayout(`^states/(?P<stack>[^/]+)\.tfstate$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.Has("region") || !layout.Has("stack") {
+		t.Errorf("Has is wrong for %v", layout)
+	}
+
+	if _, err := ParseKeyLayout("{env}/{region}/terraform.tfstate"); err == nil {
+		t.Errorf("ParseKeyLayout took a layout without a stack")
+	}
+}
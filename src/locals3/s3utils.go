@@ -2,36 +2,62 @@ package locals3
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
-	"os"
+	"net/http"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-// GetObject comment - pass in bucket and key objects - get out a string of s3 content data
-func GetObject(bucket string, key string) string {
+// GetObjectVersion gets one version of an object as a string, the current one when versionID is empty. It
+// returns an error rather than exiting, the version may well have been deleted or expired since the
+// notification was sent.
+func GetObjectVersion(bucket string, key string, versionID string) (string, error) {
 
-	svc := s3.New(session.New())
-	req, err := svc.GetObject(&s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-	})
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
 
+	svc := s3.New(session.New())
+	req, err := svc.GetObject(input)
 	if err != nil {
-		fmt.Printf("Unable to get object %v from bucket %v - err - %v\n", key, bucket, err)
-		os.Exit(2)
+		return "", fmt.Errorf("unable to get object %v (version %q) from bucket %v - %w", key, versionID, bucket, err)
+	}
+	defer req.Body.Close()
+
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "", fmt.Errorf("unable to read object %v (version %q) from bucket %v - %w", key, versionID, bucket, err)
 	}
 
 	fmt.Printf("Successful retrieval of object %v from bucket %v\n", key, bucket)
-	var reader io.Reader
-	reader = req.Body
-	data, _ := ioutil.ReadAll(reader)
-	var stringData string
-	stringData = string(data[:])
+	return string(data), nil
+
+}
+
+// ObjectGone reports whether key has really gone from bucket - there's no current version of it, so nothing
+// newer has been written since it was deleted. In a versioned bucket a key whose latest version is a delete
+// marker is gone too.
+func ObjectGone(bucket string, key string) (bool, error) {
 
-	return stringData
+	svc := s3.New(session.New())
+	_, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	if err == nil {
+		return false, nil
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return true, nil
+	}
+	return false, fmt.Errorf("unable to check for object %v in bucket %v - %w", key, bucket, err)
 
 }
@@ -0,0 +1,55 @@
+package locals3
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// StateObjectRef is the state object an S3 notification is about, tidied up so nothing downstream has to
+// know how S3 encodes things. Key is URL decoded (notifications send "+" for spaces and percent-encode
+// anything unusual), RawKey is how it arrived. VersionID is empty for unversioned buckets and Sequencer,
+// which orders events for the same key, is upper case hex.
+type StateObjectRef struct {
+	EventName string
+	Bucket    string
+	Key       string
+	RawKey    string
+	VersionID string
+	Sequencer string
+}
+
+// NewStateObjectRef decodes the object an S3 notification record is about
+func NewStateObjectRef(record events.S3EventRecord) (StateObjectRef, error) {
+
+	object := record.S3.Object
+
+	key, err := url.QueryUnescape(object.Key)
+	if err != nil {
+		return StateObjectRef{}, fmt.Errorf("unable to decode key %q - %w", object.Key, err)
+	}
+
+	versionID := object.VersionID
+	// objects written before versioning was turned on come through as version "null"
+	if versionID == "null" {
+		versionID = ""
+	}
+
+	return StateObjectRef{
+		EventName: record.EventName,
+		Bucket:    record.S3.Bucket.Name,
+		Key:       key,
+		RawKey:    object.Key,
+		VersionID: versionID,
+		Sequencer: strings.ToUpper(strings.TrimSpace(object.Sequencer)),
+	}, nil
+}
+
+func (r StateObjectRef) String() string {
+	if r.VersionID != "" {
+		return r.Bucket + "/" + r.Key + " (version " + r.VersionID + ")"
+	}
+	return r.Bucket + "/" + r.Key
+}
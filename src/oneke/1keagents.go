@@ -0,0 +1,426 @@
+package oneke
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Agent is a ThousandEyes vantage point tests can run from. Type is "cloud", "enterprise" or
+// "enterprise-cluster" whichever API version it came from.
+type Agent struct {
+	ID        string
+	Name      string
+	Type      string
+	Location  string
+	CountryID string
+	Labels    []string
+	Enabled   bool
+}
+
+// Continent is the two letter continent code for the agent's country, empty if we don't know it
+func (a Agent) Continent() string {
+	return continents[strings.ToUpper(a.CountryID)]
+}
+
+// ListAgents returns every enterprise and cloud agent the account can use
+func (c *Client) ListAgents(ctx context.Context) ([]Agent, error) {
+	c.logger.Printf("ListAgents called...\n")
+	agents, err := c.api.ListAgents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing agents: %w", err)
+	}
+	return agents, nil
+}
+
+// normaliseAgentType makes v6's "Enterprise Cluster" and v7's "enterprise-cluster" the same thing
+func normaliseAgentType(agentType string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(agentType)), " ", "-", -1)
+}
+
+// AgentSelector picks agents by what they are rather than their ID. It's written as space separated
+// key=value terms, all of which have to match:
+//
+//	label=prod-monitors            agents with the label (a group in v6)
+//	country=US                     agents in the country
+//	continent=EU                   agents on the continent (AF, AS, EU, NA, OC or SA)
+//	type=cloud                     cloud, enterprise or enterprise-cluster agents
+//	region=eu-west-1               cloud agents near the AWS region, "region=stack" means the stack's own
+//	id=14410                       the agent with the ID
+//
+// A bare agent ID with no "=" still works and is the same as id=<ID>.
+type AgentSelector struct {
+	Terms map[string]string
+}
+
+var selectorKeys = map[string]bool{"label": true, "country": true, "continent": true, "type": true, "region": true, "id": true}
+
+// ParseAgentSelector parses a selector from a template
+func ParseAgentSelector(s string) (AgentSelector, error) {
+
+	sel := AgentSelector{Terms: make(map[string]string)}
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return sel, fmt.Errorf("oneke: empty agent selector")
+	}
+
+	for _, field := range fields {
+		if !strings.Contains(field, "=") {
+			if len(fields) != 1 {
+				return sel, fmt.Errorf("oneke: agent selector %q mixes a bare ID with terms", s)
+			}
+			sel.Terms["id"] = field
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if !selectorKeys[kv[0]] {
+			return sel, fmt.Errorf("oneke: agent selector %q has unknown term %q", s, kv[0])
+		}
+		if kv[1] == "" {
+			return sel, fmt.Errorf("oneke: agent selector %q has no value for %q", s, kv[0])
+		}
+		if _, ok := sel.Terms[kv[0]]; ok {
+			return sel, fmt.Errorf("oneke: agent selector %q has %q more than once", s, kv[0])
+		}
+		sel.Terms[kv[0]] = kv[1]
+	}
+
+	if region, ok := sel.Terms["region"]; ok && region != "stack" {
+		if _, ok := awsRegions[region]; !ok {
+			return sel, fmt.Errorf("oneke: agent selector %q has unknown AWS region %q", s, region)
+		}
+	}
+
+	return sel, nil
+}
+
+// matches reports whether agent fits every term but region, which Resolve deals with
+func (sel AgentSelector) matches(agent Agent) bool {
+
+	for key, value := range sel.Terms {
+		switch key {
+		case "id":
+			if agent.ID != value {
+				return false
+			}
+		case "label":
+			if !containsFold(agent.Labels, value) {
+				return false
+			}
+		case "country":
+			if !strings.EqualFold(agent.CountryID, value) {
+				return false
+			}
+		case "continent":
+			if !strings.EqualFold(agent.Continent(), value) {
+				return false
+			}
+		case "type":
+			if agent.Type != normaliseAgentType(value) {
+				return false
+			}
+		case "region":
+			// handled by Resolve, as "near" depends on what else is available
+		}
+	}
+	return true
+}
+
+// AgentResolver turns a template's agent selectors into agent IDs. The agent list is only fetched once, so
+// make a new resolver for each invocation and share it between all the templates in it.
+type AgentResolver struct {
+	client *Client
+
+	mu     sync.Mutex
+	agents []Agent
+	loaded bool
+}
+
+// NewAgentResolver builds a resolver that lists agents with client
+func NewAgentResolver(client *Client) *AgentResolver {
+	return &AgentResolver{client: client}
+}
+
+// Agents returns every enabled agent, fetching them the first time
+func (r *AgentResolver) Agents(ctx context.Context) ([]Agent, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.loaded {
+		return r.agents, nil
+	}
+
+	agents, err := r.client.ListAgents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.agents = r.agents[:0]
+	for _, agent := range agents {
+		if agent.Enabled {
+			r.agents = append(r.agents, agent)
+		}
+	}
+	// sorted so the same selectors always come out as the same agents, otherwise drift checks would see
+	// a change every time
+	sort.Slice(r.agents, func(i, j int) bool { return r.agents[i].ID < r.agents[j].ID })
+	r.loaded = true
+
+	return r.agents, nil
+}
+
+// ResolveTemplate returns a copy of tmpl with its agent selectors swapped for agent IDs. stackRegion is the
+// stack's AWS region, used for region=stack. Templates that only list IDs come back untouched without
+// going to ThousandEyes.
+func (r *AgentResolver) ResolveTemplate(ctx context.Context, tmpl TestTemplate, stackRegion string) (TestTemplate, error) {
+
+	if !tmpl.usesAgentSelectors() {
+		return tmpl, nil
+	}
+
+	ids, err := r.Resolve(ctx, tmpl.Agents, tmpl.MinAgents, tmpl.MinContinents, tmpl.MaxAgents, stackRegion)
+	if err != nil {
+		return tmpl, fmt.Errorf("oneke: template %q: %w", tmpl.Name, err)
+	}
+
+	tmpl.Agents = ids
+	tmpl.MinAgents = 0
+	tmpl.MinContinents = 0
+	tmpl.MaxAgents = 0
+	return tmpl, nil
+}
+
+// Resolve finds the agents for a list of selectors, any agent matching any selector is in. It fails when
+// fewer than minAgents match or they don't cover minContinents. Only with maxAgents set do we trim the
+// matches down, to that many spread across as many continents as we can.
+func (r *AgentResolver) Resolve(ctx context.Context, selectors []string, minAgents int, minContinents int, maxAgents int, stackRegion string) ([]string, error) {
+
+	agents, err := r.Agents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var candidates []Agent
+
+	for _, s := range selectors {
+		sel, err := ParseAgentSelector(s)
+		if err != nil {
+			return nil, err
+		}
+
+		matched := make([]Agent, 0)
+		for _, agent := range agents {
+			if sel.matches(agent) {
+				matched = append(matched, agent)
+			}
+		}
+
+		if region, ok := sel.Terms["region"]; ok {
+			if region == "stack" {
+				if stackRegion == "" {
+					return nil, fmt.Errorf("agent selector %q wants the stack's region, but we don't know it", s)
+				}
+				region = stackRegion
+			}
+			matched = nearRegion(matched, region)
+		}
+
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("no agents match %q", s)
+		}
+
+		for _, agent := range matched {
+			if !seen[agent.ID] {
+				seen[agent.ID] = true
+				candidates = append(candidates, agent)
+			}
+		}
+	}
+
+	if len(candidates) < minAgents {
+		return nil, fmt.Errorf("wanted %d agents but only %d match", minAgents, len(candidates))
+	}
+	if maxAgents > 0 && len(candidates) > maxAgents {
+		candidates = spreadAgents(candidates, maxAgents)
+	}
+	if minContinents > 0 {
+		if n := len(continentsOf(candidates)); n < minContinents {
+			return nil, fmt.Errorf("wanted agents on %d continents but only found %d", minContinents, n)
+		}
+	}
+
+	ids := make([]string, 0, len(candidates))
+	for _, agent := range candidates {
+		ids = append(ids, agent.ID)
+	}
+	return ids, nil
+}
+
+// nearRegion narrows agents down to the cloud agents closest to an AWS region - the same city if there
+// are any, then the same country, then the same continent
+func nearRegion(agents []Agent, region string) []Agent {
+
+	near, ok := awsRegions[region]
+	if !ok {
+		return nil
+	}
+
+	var cloud []Agent
+	for _, agent := range agents {
+		if agent.Type == "cloud" {
+			cloud = append(cloud, agent)
+		}
+	}
+
+	var sameCity, sameCountry, sameContinent []Agent
+	for _, agent := range cloud {
+		for _, city := range near.cities {
+			if strings.Contains(strings.ToLower(agent.Location), strings.ToLower(city)) {
+				sameCity = append(sameCity, agent)
+				break
+			}
+		}
+		if strings.EqualFold(agent.CountryID, near.country) {
+			sameCountry = append(sameCountry, agent)
+		}
+		if agent.Continent() == continents[near.country] {
+			sameContinent = append(sameContinent, agent)
+		}
+	}
+
+	switch {
+	case len(sameCity) > 0:
+		return sameCity
+	case len(sameCountry) > 0:
+		return sameCountry
+	}
+	return sameContinent
+}
+
+// spreadAgents picks n agents taking one from each continent in turn, so "3 agents" doesn't end up as
+// 3 agents in the same city. Agents we can't place on a continent only fill in once the rest run out, they
+// don't help the spread.
+func spreadAgents(agents []Agent, n int) []Agent {
+
+	byContinent := make(map[string][]Agent)
+	var order []string
+	var unknown []Agent
+	for _, agent := range agents {
+		c := agent.Continent()
+		if c == "" {
+			unknown = append(unknown, agent)
+			continue
+		}
+		if _, ok := byContinent[c]; !ok {
+			order = append(order, c)
+		}
+		byContinent[c] = append(byContinent[c], agent)
+	}
+	sort.Strings(order)
+
+	var picked []Agent
+	for len(picked) < n {
+		added := false
+		for _, c := range order {
+			if len(byContinent[c]) == 0 || len(picked) == n {
+				continue
+			}
+			picked = append(picked, byContinent[c][0])
+			byContinent[c] = byContinent[c][1:]
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+	for _, agent := range unknown {
+		if len(picked) == n {
+			break
+		}
+		picked = append(picked, agent)
+	}
+	return picked
+}
+
+func continentsOf(agents []Agent) map[string]bool {
+	found := make(map[string]bool)
+	for _, agent := range agents {
+		if c := agent.Continent(); c != "" {
+			found[c] = true
+		}
+	}
+	return found
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// awsRegion is roughly where an AWS region is, enough to find cloud agents near it
+type awsRegion struct {
+	country string
+	cities  []string
+}
+
+var awsRegions = map[string]awsRegion{
+	"us-east-1":      {"US", []string{"Ashburn", "Virginia", "Washington"}},
+	"us-east-2":      {"US", []string{"Columbus", "Ohio"}},
+	"us-west-1":      {"US", []string{"San Francisco", "San Jose", "California"}},
+	"us-west-2":      {"US", []string{"Portland", "Oregon", "Seattle"}},
+	"ca-central-1":   {"CA", []string{"Montreal", "Toronto"}},
+	"sa-east-1":      {"BR", []string{"Sao Paulo", "São Paulo"}},
+	"eu-west-1":      {"IE", []string{"Dublin"}},
+	"eu-west-2":      {"GB", []string{"London"}},
+	"eu-west-3":      {"FR", []string{"Paris"}},
+	"eu-central-1":   {"DE", []string{"Frankfurt"}},
+	"eu-north-1":     {"SE", []string{"Stockholm"}},
+	"eu-south-1":     {"IT", []string{"Milan"}},
+	"me-south-1":     {"BH", []string{"Manama", "Bahrain"}},
+	"af-south-1":     {"ZA", []string{"Cape Town"}},
+	"ap-south-1":     {"IN", []string{"Mumbai"}},
+	"ap-east-1":      {"HK", []string{"Hong Kong"}},
+	"ap-southeast-1": {"SG", []string{"Singapore"}},
+	"ap-southeast-2": {"AU", []string{"Sydney"}},
+	"ap-northeast-1": {"JP", []string{"Tokyo"}},
+	"ap-northeast-2": {"KR", []string{"Seoul"}},
+	"ap-northeast-3": {"JP", []string{"Osaka"}},
+}
+
+// continents maps the countries ThousandEyes has agents in to their continent
+var continents = map[string]string{
+	// North America
+	"US": "NA", "CA": "NA", "MX": "NA", "PA": "NA", "CR": "NA", "GT": "NA", "PR": "NA",
+	// South America
+	"BR": "SA", "AR": "SA", "CL": "SA", "CO": "SA", "PE": "SA", "EC": "SA", "UY": "SA", "VE": "SA",
+	// Europe
+	"GB": "EU", "IE": "EU", "FR": "EU", "DE": "EU", "NL": "EU", "BE": "EU", "LU": "EU", "ES": "EU", "PT": "EU",
+	"IT": "EU", "CH": "EU", "AT": "EU", "SE": "EU", "NO": "EU", "DK": "EU", "FI": "EU", "PL": "EU", "CZ": "EU",
+	"HU": "EU", "RO": "EU", "BG": "EU", "GR": "EU", "UA": "EU", "RU": "EU", "RS": "EU", "HR": "EU", "IS": "EU",
+	// Asia
+	"IN": "AS", "SG": "AS", "JP": "AS", "KR": "AS", "CN": "AS", "HK": "AS", "TW": "AS", "MY": "AS", "TH": "AS",
+	"ID": "AS", "PH": "AS", "VN": "AS", "AE": "AS", "SA": "AS", "IL": "AS", "TR": "AS", "BH": "AS", "QA": "AS",
+	"PK": "AS", "BD": "AS", "KZ": "AS",
+	// Africa
+	"ZA": "AF", "NG": "AF", "KE": "AF", "EG": "AF", "MA": "AF", "GH": "AF", "TZ": "AF",
+	// Oceania
+	"AU": "OC", "NZ": "OC",
+}
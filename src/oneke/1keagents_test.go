@@ -0,0 +1,140 @@
+package oneke
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseAgentSelector(t *testing.T) {
+
+	tests := []struct {
+		selector string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{"14410", map[string]string{"id": "14410"}, false},
+		{"label=prod-monitors", map[string]string{"label": "prod-monitors"}, false},
+		{"type=cloud country=US", map[string]string{"type": "cloud", "country": "US"}, false},
+		{"region=stack", map[string]string{"region": "stack"}, false},
+		{"region=eu-west-1 type=cloud", map[string]string{"region": "eu-west-1", "type": "cloud"}, false},
+		{"", nil, true},
+		{"14410 type=cloud", nil, true},
+		{"colour=blue", nil, true},
+		{"label=", nil, true},
+		{"country=US country=CA", nil, true},
+		{"region=mars-north-1", nil, true},
+	}
+
+	for _, tt := range tests {
+		sel, err := ParseAgentSelector(tt.selector)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAgentSelector(%q) error = %v", tt.selector, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(sel.Terms) != len(tt.want) {
+			t.Errorf("ParseAgentSelector(%q) = %v, want %v", tt.selector, sel.Terms, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if sel.Terms[k] != v {
+				t.Errorf("ParseAgentSelector(%q) = %v, want %v", tt.selector, sel.Terms, tt.want)
+			}
+		}
+	}
+}
+
+// agents is a spread of agents, already sorted by ID the way AgentResolver keeps them
+var agents = []Agent{
+	{ID: "1", Type: "cloud", Location: "Ashburn, VA", CountryID: "US", Labels: []string{"prod-monitors"}},
+	{ID: "2", Type: "cloud", Location: "San Jose, CA", CountryID: "US"},
+	{ID: "3", Type: "cloud", Location: "Dublin, Ireland", CountryID: "IE"},
+	{ID: "4", Type: "cloud", Location: "Frankfurt, Germany", CountryID: "DE"},
+	{ID: "5", Type: "enterprise", Location: "Dublin, Ireland", CountryID: "IE", Labels: []string{"prod-monitors"}},
+	{ID: "6", Type: "cloud", Location: "Tokyo, Japan", CountryID: "JP"},
+	{ID: "7", Type: "cloud", Location: "Somewhere", CountryID: "ZZ"},
+}
+
+func TestNearRegion(t *testing.T) {
+
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{"eu-west-1", "3"},   // Dublin itself, not the enterprise agent there
+		{"us-east-1", "1"},   // Ashburn
+		{"us-east-2", "1,2"}, // no agent in the city, but some in the country
+		{"eu-west-3", "3,4"}, // nothing in France, so the rest of Europe
+		{"sa-east-1", ""},    // nothing in South America at all
+		{"mars-north-1", ""}, // not a region we know
+	}
+
+	for _, tt := range tests {
+		if got := agentIDs(nearRegion(agents, tt.region)); got != tt.want {
+			t.Errorf("nearRegion(%v) = %v, want %v", tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+
+	r := &AgentResolver{agents: agents, loaded: true}
+
+	tests := []struct {
+		name          string
+		selectors     []string
+		minAgents     int
+		minContinents int
+		maxAgents     int
+		region        string
+		want          string
+		wantErr       string
+	}{
+		{name: "ids", selectors: []string{"14410"}, wantErr: "no agents match"},
+		{name: "id", selectors: []string{"6"}, want: "6"},
+		{name: "label", selectors: []string{"label=prod-monitors"}, want: "1,5"},
+		{name: "union without repeats", selectors: []string{"country=IE", "label=prod-monitors"}, want: "3,5,1"},
+		{name: "stack region", selectors: []string{"region=stack"}, region: "eu-west-1", want: "3"},
+		{name: "stack region unknown", selectors: []string{"region=stack"}, wantErr: "don't know it"},
+		{name: "every match is kept", selectors: []string{"type=cloud"}, minAgents: 3, want: "1,2,3,4,6,7"},
+		{name: "not enough", selectors: []string{"country=US"}, minAgents: 3, wantErr: "wanted 3 agents"},
+		{name: "continents", selectors: []string{"type=cloud"}, minContinents: 3, want: "1,2,3,4,6,7"},
+		{name: "not enough continents", selectors: []string{"continent=EU"}, minContinents: 2, wantErr: "2 continents"},
+		{name: "trimmed and spread", selectors: []string{"type=cloud"}, maxAgents: 3, want: "6,3,1"},
+		{name: "unknown continent picked last", selectors: []string{"id=7", "continent=NA"}, maxAgents: 2, want: "1,2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, err := r.Resolve(context.Background(), tt.selectors, tt.minAgents, tt.minContinents, tt.maxAgents, tt.region)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Resolve = %v, %v, want an error about %q", ids, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || strings.Join(ids, ",") != tt.want {
+				t.Errorf("Resolve = %v, %v, want %v", ids, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpreadAgents(t *testing.T) {
+
+	// agents on no continent we know of still make up the numbers once the rest have run out
+	if got := agentIDs(spreadAgents([]Agent{agents[6], agents[5], agents[0]}, 3)); got != "6,1,7" {
+		t.Errorf("spreadAgents = %v, want 6,1,7", got)
+	}
+}
+
+func agentIDs(agents []Agent) string {
+	ids := make([]string, 0, len(agents))
+	for _, agent := range agents {
+		ids = append(ids, agent.ID)
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,251 @@
+package oneke
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// AlertRule is a ThousandEyes alert rule. In a TemplateConfig catalogue it's keyed by name, e.g. HTTP
+// availability dropping on 2 of 3 agents for 2 rounds out of 3:
+//
+//	"http-availability": {
+//	  "type": "http-server",
+//	  "expression": "((errorType != \"None\"))",
+//	  "minimumSources": 2,
+//	  "roundsViolatingRequired": 2,
+//	  "roundsViolatingOutOf": 3,
+//	  "severity": "major",
+//	  "integrations": [{"id": "pgd-12345", "type": "PAGER_DUTY"}]
+//	}
+//
+// The rule's name in ThousandEyes is the catalogue name, which is how we find it again.
+type AlertRule struct {
+	ID                      string             `json:"-"`
+	Name                    string             `json:"-"`
+	TestType                string             `json:"type"`
+	Expression              string             `json:"expression"`
+	MinimumSources          int                `json:"minimumSources,omitempty"`
+	MinimumSourcesPct       int                `json:"minimumSourcesPct,omitempty"`
+	RoundsViolatingRequired int                `json:"roundsViolatingRequired,omitempty"`
+	RoundsViolatingOutOf    int                `json:"roundsViolatingOutOf,omitempty"`
+	Severity                string             `json:"severity,omitempty"`
+	Emails                  []string           `json:"emails,omitempty"`
+	Integrations            []AlertIntegration `json:"integrations,omitempty"`
+}
+
+// AlertIntegration is a third party integration an alert rule notifies, PagerDuty for anything that pages
+type AlertIntegration struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+func (i AlertIntegration) String() string {
+	return i.Type + ":" + i.ID
+}
+
+// Validate checks a rule is complete enough to send
+func (r AlertRule) Validate() error {
+
+	var problems []string
+
+	if _, ok := alertTypesV6[r.TestType]; !ok {
+		problems = append(problems, fmt.Sprintf("unsupported test type %q", r.TestType))
+	}
+	if strings.TrimSpace(r.Expression) == "" {
+		problems = append(problems, "no expression")
+	}
+	if r.MinimumSources < 0 || r.MinimumSourcesPct < 0 || r.MinimumSourcesPct > 100 {
+		problems = append(problems, "minimum sources out of range")
+	}
+	if r.RoundsViolatingRequired < 0 || (r.RoundsViolatingOutOf > 0 && r.RoundsViolatingRequired > r.RoundsViolatingOutOf) {
+		problems = append(problems, fmt.Sprintf("can't violate %d rounds out of %d", r.RoundsViolatingRequired, r.RoundsViolatingOutOf))
+	}
+	for _, integration := range r.Integrations {
+		if integration.ID == "" || integration.Type == "" {
+			problems = append(problems, "integrations need an id and type")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("oneke: alert rule %q: %v", r.Name, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// diffAlertRules compares a rule in ThousandEyes with the catalogue's version of it
+func diffAlertRules(have AlertRule, want AlertRule) TestDiff {
+
+	var diff TestDiff
+
+	add := func(field string, h interface{}, w interface{}) {
+		diff = append(diff, FieldDiff{Field: field, Have: h, Want: w})
+	}
+
+	if have.TestType != want.TestType {
+		add("type", have.TestType, want.TestType)
+	}
+	if have.Expression != want.Expression {
+		add("expression", have.Expression, want.Expression)
+	}
+	if have.MinimumSources != want.MinimumSources {
+		add("minimumSources", have.MinimumSources, want.MinimumSources)
+	}
+	if have.MinimumSourcesPct != want.MinimumSourcesPct {
+		add("minimumSourcesPct", have.MinimumSourcesPct, want.MinimumSourcesPct)
+	}
+	if want.RoundsViolatingRequired != 0 && have.RoundsViolatingRequired != want.RoundsViolatingRequired {
+		add("roundsViolatingRequired", have.RoundsViolatingRequired, want.RoundsViolatingRequired)
+	}
+	if want.RoundsViolatingOutOf != 0 && have.RoundsViolatingOutOf != want.RoundsViolatingOutOf {
+		add("roundsViolatingOutOf", have.RoundsViolatingOutOf, want.RoundsViolatingOutOf)
+	}
+	if want.Severity != "" && !strings.EqualFold(have.Severity, want.Severity) {
+		add("severity", have.Severity, want.Severity)
+	}
+	if !sameSet(have.Emails, want.Emails) {
+		add("emails", have.Emails, want.Emails)
+	}
+	if !sameSet(integrationStrings(have.Integrations), integrationStrings(want.Integrations)) {
+		add("integrations", have.Integrations, want.Integrations)
+	}
+
+	return diff
+}
+
+func integrationStrings(integrations []AlertIntegration) []string {
+	s := make([]string, 0, len(integrations))
+	for _, integration := range integrations {
+		s = append(s, integration.String())
+	}
+	return s
+}
+
+// ThousandEyes' alert types for each of our test types
+var (
+	alertTypesV6 = map[string]string{
+		TestTypeHTTPServer:    "HTTP Server",
+		TestTypePageLoad:      "Page Load",
+		TestTypeAgentToServer: "End-to-End (Server)",
+		TestTypeDNSServer:     "DNS Server",
+		TestTypeDNSTrace:      "DNS Trace",
+		TestTypeAPI:           "API",
+	}
+	alertTypesV7 = map[string]string{
+		TestTypeHTTPServer:    "http-server",
+		TestTypePageLoad:      "page-load",
+		TestTypeAgentToServer: "end-to-end-server",
+		TestTypeDNSServer:     "dns-server",
+		TestTypeDNSTrace:      "dns-trace",
+		TestTypeAPI:           "api",
+	}
+)
+
+// testTypeForAlertType goes back from an alert type to our test type, empty for alert types we don't use
+func testTypeForAlertType(alertTypes map[string]string, alertType string) string {
+	for testType, other := range alertTypes {
+		if other == alertType {
+			return testType
+		}
+	}
+	return ""
+}
+
+// ListAlertRules returns every alert rule in the account
+func (c *Client) ListAlertRules(ctx context.Context) ([]AlertRule, error) {
+	c.logger.Printf("ListAlertRules called...\n")
+	rules, err := c.api.ListAlertRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing alert rules: %w", err)
+	}
+	return rules, nil
+}
+
+// EnsureAlertRule makes sure ThousandEyes has the rule as want describes it, creating it if there's no rule
+// with its name and updating it in place if it has drifted. Rules are remembered until ResetCaches, like
+// labels.
+func (c *Client) EnsureAlertRule(ctx context.Context, want AlertRule) (AlertRule, error) {
+
+	if err := want.Validate(); err != nil {
+		return AlertRule{}, err
+	}
+
+	c.alertRulesMu.Lock()
+	defer c.alertRulesMu.Unlock()
+
+	if c.alertRules == nil {
+		rules, err := c.ListAlertRules(ctx)
+		if err != nil {
+			return AlertRule{}, err
+		}
+		c.alertRules = make(map[string]AlertRule)
+		for _, rule := range rules {
+			c.alertRules[rule.Name] = rule
+		}
+	}
+
+	have, ok := c.alertRules[want.Name]
+	if !ok {
+		// pretend, without remembering it, like EnsureLabel
+		if IsDryRun(ctx) {
+			c.logger.Printf("Dry run - not creating Alert Rule: %v\n", want.Name)
+			want.ID = dryRunID(want.Name)
+			return want, nil
+		}
+		c.logger.Printf("Creating Alert Rule: %v\n", want.Name)
+		created, err := c.api.CreateAlertRule(ctx, want)
+		if err != nil {
+			return AlertRule{}, fmt.Errorf("creating alert rule %v: %w", want.Name, err)
+		}
+		// remember the rule as we asked for it, the response doesn't always echo everything back
+		want.ID = created.ID
+		c.alertRules[want.Name] = want
+		return want, nil
+	}
+
+	diff := diffAlertRules(have, want)
+	if len(diff) == 0 {
+		return have, nil
+	}
+
+	if IsDryRun(ctx) {
+		c.logger.Printf("Dry run - not updating Alert Rule %v - %v\n", want.Name, diff)
+		want.ID = have.ID
+		return want, nil
+	}
+
+	c.logger.Printf("Alert rule %v has drifted - %v - updating\n", want.Name, diff)
+	if _, err := c.api.UpdateAlertRule(ctx, have.ID, want); err != nil {
+		return AlertRule{}, fmt.Errorf("updating alert rule %v: %w", want.Name, err)
+	}
+	want.ID = have.ID
+	c.alertRules[want.Name] = want
+	return want, nil
+}
+
+// ApplyAlertRules attaches the catalogue's alert rules for tier to a copy of tmpl, making sure each exists
+// in ThousandEyes first, and turns alerts on. Rules are only attached to tests of their own type. When the
+// tier has none the template comes back as it is, so tiers without rules stay quiet unless the template
+// itself says otherwise.
+func (c *Client) ApplyAlertRules(ctx context.Context, tc *TemplateConfig, tmpl TestTemplate, tier string) (TestTemplate, error) {
+
+	rules := tc.AlertRulesFor(tier, tmpl.Type)
+	if len(rules) == 0 {
+		return tmpl, nil
+	}
+
+	ids := append([]string(nil), tmpl.AlertRules...)
+	for _, rule := range rules {
+		ensured, err := c.EnsureAlertRule(ctx, rule)
+		if err != nil {
+			return tmpl, err
+		}
+		if !contains(ids, ensured.ID) {
+			ids = append(ids, ensured.ID)
+		}
+	}
+
+	tmpl.AlertRules = ids
+	tmpl.AlertsEnabled = true
+	return tmpl, nil
+}
@@ -0,0 +1,194 @@
+package oneke
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// APIVersion picks which ThousandEyes API the client talks to
+type APIVersion string
+
+// The API versions we know how to speak
+const (
+	V6 APIVersion = "v6"
+	V7 APIVersion = "v7"
+)
+
+// ParseAPIVersion turns a config value into an APIVersion, an empty string means V6
+func ParseAPIVersion(s string) (APIVersion, error) {
+	switch APIVersion(s) {
+	case "", V6:
+		return V6, nil
+	case V7:
+		return V7, nil
+	}
+	return "", fmt.Errorf("oneke: unknown API version %q", s)
+}
+
+// TestsAPI is what each ThousandEyes API version has to provide. Implementations map their own wire format
+// onto the shared Test and TestSpec types so nothing outside this package cares which version is in use.
+type TestsAPI interface {
+	// ListTests returns an iterator over every test in the account
+	ListTests(ctx context.Context) *TestIterator
+	// CreateTest creates a test from spec and returns it as ThousandEyes now sees it
+	CreateTest(ctx context.Context, spec TestSpec) (Test, error)
+	// GetTest fetches the full details of a test, as a spec so it can be compared with the one we want
+	GetTest(ctx context.Context, testType string, id string) (TestSpec, error)
+	// UpdateTest changes an existing test in place to match spec
+	UpdateTest(ctx context.Context, testType string, id string, spec TestSpec) (Test, error)
+	// DeleteTest removes the test with the given type and ID
+	DeleteTest(ctx context.Context, testType string, id string) error
+	// ListAgents returns every enterprise and cloud agent
+	ListAgents(ctx context.Context) ([]Agent, error)
+	// ListLabels returns every test label (a group in v6)
+	ListLabels(ctx context.Context) ([]Label, error)
+	// CreateLabel makes a new, empty test label
+	CreateLabel(ctx context.Context, name string) (Label, error)
+	// LabelTests returns the tests carrying a label
+	LabelTests(ctx context.Context, labelID string) ([]Test, error)
+	// ListAlertRules returns every alert rule
+	ListAlertRules(ctx context.Context) ([]AlertRule, error)
+	// CreateAlertRule makes a new alert rule
+	CreateAlertRule(ctx context.Context, rule AlertRule) (AlertRule, error)
+	// UpdateAlertRule changes an existing alert rule to match rule
+	UpdateAlertRule(ctx context.Context, id string, rule AlertRule) (AlertRule, error)
+}
+
+// The test types we know how to create
+const (
+	TestTypeHTTPServer    = "http-server"
+	TestTypePageLoad      = "page-load"
+	TestTypeAgentToServer = "agent-to-server"
+	TestTypeDNSServer     = "dns-server"
+	TestTypeDNSTrace      = "dns-trace"
+	TestTypeAPI           = "api"
+)
+
+// Test is a ThousandEyes test as the rest of the code sees it. IDs are strings as v7 sends them that way.
+// Which of URL, Server and Domain is set depends on the type, Target picks the right one. Labels are v7
+// labels or v6 groups.
+//
+// Ownership is only set on tests from Inventory.ForStack or WithOwnership and says why the test was counted
+// as the stack's. Details is only set once Client.LoadDetails has fetched the test's full configuration.
+type Test struct {
+	ID       string
+	Name     string
+	Type     string
+	URL      string
+	Server   string
+	Domain   string
+	Enabled  bool
+	Interval int
+	Labels   []string
+
+	Ownership string
+	Details   *TestSpec
+}
+
+// Target is what the test points at - a URL for web tests, a host for network tests and a domain for DNS
+func (t Test) Target() string {
+	switch {
+	case t.URL != "":
+		return t.URL
+	case t.Server != "":
+		return t.Server
+	}
+	return t.Domain
+}
+
+// TestSpec describes a test we want ThousandEyes to create. Fields that don't apply to Type are ignored.
+type TestSpec struct {
+	Name                string
+	Type                string
+	Interval            int
+	AgentIDs            []string
+	AlertsEnabled       bool
+	AlertRuleIDs        []string
+	LabelIDs            []string
+	BGPMeasurements     bool
+	NetworkMeasurements bool
+
+	// http-server, page-load and api
+	URL                string
+	ContentRegex       string
+	TimeoutMs          int
+	Headers            []string
+	ExpectedStatusCode int
+	VerifyCertificate  bool
+
+	// page-load
+	PageLoadInterval int
+
+	// agent-to-server
+	Server   string
+	Port     int
+	Protocol string
+
+	// dns-server and dns-trace
+	Domain     string
+	DNSServers []string
+
+	// api
+	Method      string
+	RequestBody string
+}
+
+// Target is what the spec points at, the same way Test.Target works
+func (s TestSpec) Target() string {
+	switch s.Type {
+	case TestTypeAgentToServer:
+		return s.Server
+	case TestTypeDNSServer, TestTypeDNSTrace:
+		return s.Domain
+	}
+	return s.URL
+}
+
+// TestKey is how we tell tests apart when reconciling - one of each type per target
+func TestKey(testType string, target string) string {
+	return testType + "~" + target
+}
+
+// newTestsAPI builds the TestsAPI implementation for a version
+func newTestsAPI(c *Client, version APIVersion) TestsAPI {
+	if version == V7 {
+		return &v7API{client: c}
+	}
+	return &v6API{client: c}
+}
+
+// boolToInt is for v6, which wants 0 and 1 rather than booleans
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// statusCodeString is for desiredStatusCode, which both versions send as a string. 0 means "leave it to
+// ThousandEyes", which treats any 2xx as success.
+func statusCodeString(code int) string {
+	if code == 0 {
+		return ""
+	}
+	return strconv.Itoa(code)
+}
+
+// metricFor is the metric name we put in test names for each type, web_check is what http-server tests
+// have always been called
+func metricFor(testType string) string {
+	switch testType {
+	case TestTypePageLoad:
+		return "page_load"
+	case TestTypeAgentToServer:
+		return "network"
+	case TestTypeDNSServer:
+		return "dns_server"
+	case TestTypeDNSTrace:
+		return "dns_trace"
+	case TestTypeAPI:
+		return "api_check"
+	}
+	return "web_check"
+}
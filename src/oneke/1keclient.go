@@ -0,0 +1,269 @@
+package oneke
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// DefaultBaseURL is the ThousandEyes API root used when no base URL is given
+const DefaultBaseURL = "https://api.thousandeyes.com/v6"
+
+// DefaultV7BaseURL is the API root used instead of DefaultBaseURL when the client is set up for V7
+const DefaultV7BaseURL = "https://api.thousandeyes.com/v7"
+
+// DefaultUserAgent is sent on every request unless overridden with WithUserAgent
+const DefaultUserAgent = "1keTestReconciler"
+
+// Client talks to the ThousandEyes API. Build one with NewClient and share it across a reconcile pass so
+// the underlying connection pool gets reused.
+type Client struct {
+	version      APIVersion
+	api          TestsAPI
+	baseURL      string
+	credentials  CredentialsProvider
+	auth         Authenticator
+	authMode     AuthMode
+	httpClient   *http.Client
+	userAgent    string
+	logger       *log.Logger
+	retry        RetryConfig
+	responseHook ResponseHook
+	ownership    *OwnershipRules
+
+	// labels and alert rules found or made by EnsureLabel and EnsureAlertRule, until ResetCaches
+	labelsMu sync.Mutex
+	labels   map[string]Label
+
+	alertRulesMu sync.Mutex
+	alertRules   map[string]AlertRule
+}
+
+// ResetCaches forgets the labels and alert rules the client has seen, so the next EnsureLabel and
+// EnsureAlertRule go back to ThousandEyes. A client that outlives a single run (a Lambda's, kept warm)
+// should be reset at the start of each one, or edits made in the UI in between are never noticed.
+func (c *Client) ResetCaches() {
+
+	c.labelsMu.Lock()
+	c.labels = nil
+	c.labelsMu.Unlock()
+
+	c.alertRulesMu.Lock()
+	c.alertRules = nil
+	c.alertRulesMu.Unlock()
+}
+
+// ResponseHook gets a look at every raw response and its body, it's there for debugging and must not hang
+// on to either
+type ResponseHook func(resp *http.Response, body []byte)
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithAPIVersion picks which ThousandEyes API the client talks to, V6 unless told otherwise
+func WithAPIVersion(version APIVersion) Option {
+	return func(c *Client) {
+		c.version = version
+	}
+}
+
+// WithBaseURL points the client at a different API root, handy for an httptest stand-in
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
+}
+
+// WithCredentials sets where the client gets its user and token from
+func WithCredentials(provider CredentialsProvider) Option {
+	return func(c *Client) {
+		c.credentials = provider
+	}
+}
+
+// WithAuthenticator overrides how requests are authenticated. Without it v6 clients use BasicAuth and v7
+// clients use BearerAuth, both fed by the client's credentials provider.
+func WithAuthenticator(auth Authenticator) Option {
+	return func(c *Client) {
+		c.auth = auth
+	}
+}
+
+// WithAuthMode picks one of the built in authenticators, fed by the client's credentials provider
+func WithAuthMode(mode AuthMode) Option {
+	return func(c *Client) {
+		c.authMode = mode
+	}
+}
+
+// WithHTTPClient sets the http.Client used for every request
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetry sets how rate limited and failed requests are retried, MaxRetries of 0 turns retries off
+// but we'll still wait for the rate limit to reset
+func WithRetry(config RetryConfig) Option {
+	return func(c *Client) {
+		c.retry = config
+	}
+}
+
+// WithResponseHook registers a hook that sees every raw response from ThousandEyes
+func WithResponseHook(hook ResponseHook) Option {
+	return func(c *Client) {
+		c.responseHook = hook
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent to ThousandEyes
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithLogger sets where the client writes its progress messages
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithOwnershipRules sets how GatherTestsForStack decides which tests are a stack's
+func WithOwnershipRules(rules *OwnershipRules) Option {
+	return func(c *Client) {
+		c.ownership = rules
+	}
+}
+
+// NewClient builds a Client. Without options it behaves like the old package functions did - v6 API,
+// credentials from the usual Secrets Manager secret and logging to stdout - plus credential caching for
+// DefaultCredentialsTTL and rate limit handling with DefaultRetryConfig.
+func NewClient(opts ...Option) *Client {
+
+	c := &Client{
+		version:     V6,
+		credentials: NewCachingProvider(NewSecretsManagerProvider(DefaultSecretID, DefaultSecretRegion), DefaultCredentialsTTL),
+		httpClient:  &http.Client{},
+		userAgent:   DefaultUserAgent,
+		logger:      log.New(os.Stdout, "", 0),
+		retry:       DefaultRetryConfig,
+		ownership:   DefaultOwnershipRules(),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.baseURL == "" {
+		c.baseURL = DefaultBaseURL
+		if c.version == V7 {
+			c.baseURL = DefaultV7BaseURL
+		}
+	}
+	if c.auth == nil {
+		c.auth = defaultAuthenticator(c.version, c.authMode, c.credentials)
+	}
+	c.api = newTestsAPI(c, c.version)
+
+	// Wrap whatever transport we've ended up with so every call respects the org's rate limit. We take a
+	// copy of the http.Client so we don't change one the caller handed us.
+	if _, ok := c.httpClient.Transport.(*RateLimitTransport); !ok {
+		httpClient := *c.httpClient
+		transport := NewRateLimitTransport(httpClient.Transport, c.retry)
+		transport.Logger = c.logger
+		httpClient.Transport = transport
+		c.httpClient = &httpClient
+	}
+
+	return c
+}
+
+// make1keRequest sends a request to ThousandEyes and hands back the whole body. The response is always read
+// in full and closed here so connections go back to the pool, callers never see it. Anything other than a
+// 2xx comes back as an *APIError.
+func (c *Client) make1keRequest(ctx context.Context, reqType string, reqEndpoint string, reqPayload []byte) ([]byte, error) {
+
+	c.logger.Printf("make1keRequest called...\n")
+
+	// reads are all GETs, so anything else would change something
+	if IsDryRun(ctx) && reqType != http.MethodGet {
+		return nil, fmt.Errorf("%w: %v %v", ErrDryRun, reqType, reqEndpoint)
+	}
+	reqBody := bytes.NewBuffer(reqPayload)
+
+	baseurl := c.baseURL + reqEndpoint
+
+	req, err := http.NewRequestWithContext(ctx, reqType, baseurl, reqBody)
+	if err != nil {
+		return nil, &TransportError{Method: reqType, Endpoint: reqEndpoint, Err: err}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	if err := c.auth.Authenticate(ctx, req); err != nil {
+		return nil, &AuthError{Err: err}
+	}
+	resp, err := c.httpClient.Do(req)
+
+	if err != nil {
+		return nil, &TransportError{Method: reqType, Endpoint: reqEndpoint, Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &TransportError{Method: reqType, Endpoint: reqEndpoint, Err: err}
+	}
+
+	if c.responseHook != nil {
+		c.responseHook(resp, body)
+	}
+
+	if err := checkResponse(resp, body, reqEndpoint); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+
+}
+
+// make1keJSONRequest marshals payload (when there is one), sends it and decodes the response into out
+// (when that isn't nil)
+func (c *Client) make1keJSONRequest(ctx context.Context, reqType string, reqEndpoint string, payload interface{}, out interface{}) error {
+
+	var reqPayload []byte
+	if payload != nil {
+		var err error
+		reqPayload, err = json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("oneke: unable to encode request for %v: %w", reqEndpoint, err)
+		}
+	}
+
+	body, err := c.make1keRequest(ctx, reqType, reqEndpoint, reqPayload)
+	if err != nil {
+		return err
+	}
+
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return &DecodeError{Endpoint: reqEndpoint, Err: err}
+	}
+
+	return nil
+
+}
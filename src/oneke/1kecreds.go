@@ -0,0 +1,279 @@
+package oneke
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+// Credentials holds what we use to identify ourselves to ThousandEyes. Which fields matter depends on the
+// Authenticator - Basic wants User and Token, Bearer wants BearerToken (or Token), and AccountGroupID is
+// optional for either.
+type Credentials struct {
+	User           string `json:"user,omitempty"`
+	Token          string `json:"token,omitempty"`
+	BearerToken    string `json:"bearerToken,omitempty"`
+	AccountGroupID string `json:"accountGroupId,omitempty"`
+}
+
+// CredentialsProvider hands back ThousandEyes credentials when the client needs them
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// CredentialsFunc lets a plain function act as a CredentialsProvider
+type CredentialsFunc func(ctx context.Context) (Credentials, error)
+
+// Credentials calls f
+func (f CredentialsFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// Where the credentials have always lived, and how long NewClient's default provider holds on to them
+const (
+	DefaultSecretID       = "some-api"
+	DefaultSecretRegion   = "us-west-2"
+	DefaultCredentialsTTL = 15 * time.Minute
+)
+
+// SecretsManagerProvider reads credentials from a JSON secret in AWS Secrets Manager.
+//
+// With UserField and TokenField set the secret is read as an object and those fields are used. Left empty
+// we fall back to the old layout of a single {"<user>": "<token>"} pair.
+type SecretsManagerProvider struct {
+	SecretID          string
+	Region            string
+	VersionStage      string
+	UserField         string
+	TokenField        string
+	BearerTokenField  string
+	AccountGroupField string
+
+	once sync.Once
+	svc  secretsmanageriface.SecretsManagerAPI
+}
+
+// NewSecretsManagerProvider builds a provider for secretID in region, reading the AWSCURRENT version
+func NewSecretsManagerProvider(secretID string, region string) *SecretsManagerProvider {
+	return &SecretsManagerProvider{
+		SecretID:     secretID,
+		Region:       region,
+		VersionStage: "AWSCURRENT",
+	}
+}
+
+// WithClient has the provider use svc instead of building its own, e.g. one set up for another account
+func (p *SecretsManagerProvider) WithClient(svc secretsmanageriface.SecretsManagerAPI) *SecretsManagerProvider {
+	p.svc = svc
+	return p
+}
+
+// Credentials implements CredentialsProvider
+func (p *SecretsManagerProvider) Credentials(ctx context.Context) (Credentials, error) {
+
+	// Built on first use rather than in NewSecretsManagerProvider, so WithClient can get in first
+	p.once.Do(func() {
+		if p.svc == nil {
+			p.svc = secretsmanager.New(session.New(), aws.NewConfig().WithRegion(p.Region))
+		}
+	})
+
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(p.SecretID),
+	}
+	if p.VersionStage != "" {
+		input.VersionStage = aws.String(p.VersionStage)
+	}
+
+	result, err := p.svc.GetSecretValueWithContext(ctx, input)
+	if err != nil {
+		return Credentials{}, p.classify(err)
+	}
+
+	if result.SecretString == nil {
+		return Credentials{}, p.credentialsError(ErrMalformedSecret, fmt.Errorf("secret has no string value"))
+	}
+
+	return p.parse(*result.SecretString)
+}
+
+// classify maps the Secrets Manager error codes we can do something about onto our own errors
+func (p *SecretsManagerProvider) classify(err error) error {
+
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case secretsmanager.ErrCodeResourceNotFoundException:
+			// We can't find the resource that you asked for.
+			return p.credentialsError(ErrSecretNotFound, err)
+		case secretsmanager.ErrCodeDecryptionFailure:
+			// Secrets Manager can't decrypt the protected secret text using the provided KMS key.
+			return p.credentialsError(ErrSecretDecryption, err)
+		}
+	}
+
+	return fmt.Errorf("oneke: unable to read secret %v: %w", p.SecretID, err)
+}
+
+func (p *SecretsManagerProvider) credentialsError(kind error, err error) error {
+	return &CredentialsError{Source: "secret " + p.SecretID, Kind: kind, Err: err}
+}
+
+// parse pulls the credentials out of the secret's JSON
+func (p *SecretsManagerProvider) parse(secretString string) (Credentials, error) {
+
+	var secretJSON map[string]string
+	if err := json.Unmarshal([]byte(secretString), &secretJSON); err != nil {
+		// don't wrap err, json errors can quote the secret back at us
+		return Credentials{}, p.credentialsError(ErrMalformedSecret, fmt.Errorf("not a JSON object of strings"))
+	}
+
+	var creds Credentials
+	legacy := p.UserField == "" && p.TokenField == ""
+
+	if legacy {
+		// old layout, the one key is the user and its value the token
+		if len(secretJSON) != 1 {
+			return Credentials{}, p.credentialsError(ErrMalformedSecret, fmt.Errorf("%d keys, expected a single user/token pair", len(secretJSON)))
+		}
+		for user, token := range secretJSON {
+			creds.User = user
+			creds.Token = token
+		}
+	} else {
+		creds = Credentials{
+			User:           fieldOrEmpty(secretJSON, p.UserField),
+			Token:          fieldOrEmpty(secretJSON, p.TokenField),
+			BearerToken:    fieldOrEmpty(secretJSON, p.BearerTokenField),
+			AccountGroupID: fieldOrEmpty(secretJSON, p.AccountGroupField),
+		}
+	}
+
+	// Only complain about fields we were told to look for, it's down to the authenticator whether what we
+	// end up with is enough
+	if (legacy || p.UserField != "") && creds.User == "" {
+		return Credentials{}, p.credentialsError(ErrMissingUser, nil)
+	}
+	if (legacy || p.TokenField != "") && creds.Token == "" {
+		return Credentials{}, p.credentialsError(ErrMissingToken, nil)
+	}
+	if p.BearerTokenField != "" && creds.BearerToken == "" {
+		return Credentials{}, p.credentialsError(ErrMissingToken, nil)
+	}
+
+	return creds, nil
+}
+
+func fieldOrEmpty(m map[string]string, field string) string {
+	if field == "" {
+		return ""
+	}
+	return m[field]
+}
+
+// EnvProvider reads credentials from environment variables, any variable left unset is just skipped
+type EnvProvider struct {
+	UserVar         string
+	TokenVar        string
+	BearerTokenVar  string
+	AccountGroupVar string
+}
+
+// NewEnvProvider uses ONEKE_USER, ONEKE_TOKEN, ONEKE_BEARER_TOKEN and ONEKE_ACCOUNT_GROUP_ID
+func NewEnvProvider() *EnvProvider {
+	return &EnvProvider{
+		UserVar:         "ONEKE_USER",
+		TokenVar:        "ONEKE_TOKEN",
+		BearerTokenVar:  "ONEKE_BEARER_TOKEN",
+		AccountGroupVar: "ONEKE_ACCOUNT_GROUP_ID",
+	}
+}
+
+// Credentials implements CredentialsProvider
+func (p *EnvProvider) Credentials(ctx context.Context) (Credentials, error) {
+	return Credentials{
+		User:           getenv(p.UserVar),
+		Token:          getenv(p.TokenVar),
+		BearerToken:    getenv(p.BearerTokenVar),
+		AccountGroupID: getenv(p.AccountGroupVar),
+	}, nil
+}
+
+func getenv(name string) string {
+	if name == "" {
+		return ""
+	}
+	return os.Getenv(name)
+}
+
+// FileProvider reads credentials from a local JSON file with user, token, bearerToken and accountGroupId
+// fields. It's meant for running the reconciler by hand.
+type FileProvider struct {
+	Path string
+}
+
+// Credentials implements CredentialsProvider
+func (p *FileProvider) Credentials(ctx context.Context) (Credentials, error) {
+
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("oneke: unable to read credentials file: %w", err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return Credentials{}, &CredentialsError{Source: "file " + p.Path, Kind: ErrMalformedSecret, Err: fmt.Errorf("not valid JSON")}
+	}
+
+	return creds, nil
+}
+
+// CachingProvider holds on to another provider's credentials for TTL so a reconcile pass only goes to
+// Secrets Manager once. Failures aren't cached.
+type CachingProvider struct {
+	Provider CredentialsProvider
+	TTL      time.Duration
+
+	now func() time.Time
+
+	mu        sync.Mutex
+	creds     Credentials
+	fetchedAt time.Time
+	cached    bool
+}
+
+// NewCachingProvider wraps provider with a cache that lives for ttl
+func NewCachingProvider(provider CredentialsProvider, ttl time.Duration) *CachingProvider {
+	return &CachingProvider{Provider: provider, TTL: ttl, now: time.Now}
+}
+
+// Credentials implements CredentialsProvider
+func (p *CachingProvider) Credentials(ctx context.Context) (Credentials, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cached && p.now().Sub(p.fetchedAt) < p.TTL {
+		return p.creds, nil
+	}
+
+	creds, err := p.Provider.Credentials(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	p.creds = creds
+	p.fetchedAt = p.now()
+	p.cached = true
+
+	return creds, nil
+}
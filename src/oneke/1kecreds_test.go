@@ -0,0 +1,180 @@
+package oneke
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+func TestEnvProvider(t *testing.T) {
+
+	t.Setenv("ONEKE_USER", "someone@company.com")
+	t.Setenv("ONEKE_TOKEN", "abc123")
+	t.Setenv("ONEKE_BEARER_TOKEN", "")
+	t.Setenv("ONEKE_ACCOUNT_GROUP_ID", "42")
+
+	creds, err := NewEnvProvider().Credentials(context.Background())
+	want := Credentials{User: "someone@company.com", Token: "abc123", AccountGroupID: "42"}
+	if err != nil || creds != want {
+		t.Errorf("Credentials = %+v, %v, want %+v", creds, err, want)
+	}
+
+	// a provider told not to look at a variable leaves it empty
+	creds, _ = (&EnvProvider{TokenVar: "ONEKE_TOKEN"}).Credentials(context.Background())
+	if creds != (Credentials{Token: "abc123"}) {
+		t.Errorf("Credentials = %+v, want just the token", creds)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want Credentials
+		err  error
+	}{
+		{"basic", write("basic.json", `{"user": "someone@company.com", "token": "abc123"}`), Credentials{User: "someone@company.com", Token: "abc123"}, nil},
+		{"bearer", write("bearer.json", `{"bearerToken": "xyz", "accountGroupId": "42"}`), Credentials{BearerToken: "xyz", AccountGroupID: "42"}, nil},
+		{"not json", write("bad.json", `user=someone`), Credentials{}, ErrMalformedSecret},
+		{"missing", filepath.Join(dir, "missing.json"), Credentials{}, os.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := (&FileProvider{Path: tt.path}).Credentials(context.Background())
+			if creds != tt.want || (tt.err == nil) != (err == nil) || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Errorf("Credentials = %+v, %v, want %+v, %v", creds, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+type fakeSecrets struct {
+	secretsmanageriface.SecretsManagerAPI
+	value *string
+	err   error
+}
+
+func (f *fakeSecrets) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	return &secretsmanager.GetSecretValueOutput{SecretString: f.value}, f.err
+}
+
+func TestSecretsManagerProvider(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		fields bool
+		secret *secretsmanager.GetSecretValueOutput
+		svcErr error
+		want   Credentials
+		err    error
+	}{
+		{name: "legacy pair", secret: secret(`{"someone@company.com": "abc123"}`), want: Credentials{User: "someone@company.com", Token: "abc123"}},
+		{name: "legacy with two keys", secret: secret(`{"a": "1", "b": "2"}`), err: ErrMalformedSecret},
+		{name: "fields", fields: true, secret: secret(`{"user": "someone@company.com", "token": "abc123"}`), want: Credentials{User: "someone@company.com", Token: "abc123"}},
+		{name: "field missing", fields: true, secret: secret(`{"user": "someone@company.com"}`), err: ErrMissingToken},
+		{name: "not json", secret: secret(`abc123`), err: ErrMalformedSecret},
+		{name: "no string", secret: &secretsmanager.GetSecretValueOutput{}, err: ErrMalformedSecret},
+		{name: "not found", svcErr: awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "nope", nil), err: ErrSecretNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			svc := &fakeSecrets{err: tt.svcErr}
+			if tt.secret != nil {
+				svc.value = tt.secret.SecretString
+			}
+			p := NewSecretsManagerProvider(DefaultSecretID, DefaultSecretRegion).WithClient(svc)
+			if tt.fields {
+				p.UserField, p.TokenField = "user", "token"
+			}
+
+			creds, err := p.Credentials(context.Background())
+			if creds != tt.want || (tt.err == nil) != (err == nil) || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Errorf("Credentials = %+v, %v, want %+v, %v", creds, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func secret(s string) *secretsmanager.GetSecretValueOutput {
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(s)}
+}
+
+// countingProvider hands out a new token each time it's asked, or fails while err is set
+type countingProvider struct {
+	calls int
+	err   error
+}
+
+func (p *countingProvider) Credentials(ctx context.Context) (Credentials, error) {
+	p.calls++
+	if p.err != nil {
+		return Credentials{}, p.err
+	}
+	return Credentials{User: "someone", Token: string(rune('a' + p.calls - 1))}, nil
+}
+
+func TestCachingProvider(t *testing.T) {
+
+	ctx := context.Background()
+	now := time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	inner := &countingProvider{}
+	p := NewCachingProvider(inner, time.Minute)
+	p.now = func() time.Time { return now }
+
+	token := func() string {
+		t.Helper()
+		creds, err := p.Credentials(ctx)
+		if err != nil {
+			t.Fatalf("Credentials = %v", err)
+		}
+		return creds.Token
+	}
+
+	if got := token(); got != "a" {
+		t.Errorf("first token = %q, want a", got)
+	}
+
+	now = now.Add(59 * time.Second)
+	if got := token(); got != "a" || inner.calls != 1 {
+		t.Errorf("token inside the TTL = %q after %d calls, want the cached a", got, inner.calls)
+	}
+
+	now = now.Add(time.Second)
+	if got := token(); got != "b" || inner.calls != 2 {
+		t.Errorf("token after the TTL = %q after %d calls, want a fresh b", got, inner.calls)
+	}
+
+	// failures come straight back and aren't cached, the next call tries again
+	now = now.Add(time.Minute)
+	inner.err = ErrSecretNotFound
+	if _, err := p.Credentials(ctx); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("Credentials = %v, want ErrSecretNotFound", err)
+	}
+	inner.err = nil
+	if got := token(); got != "d" || inner.calls != 4 {
+		t.Errorf("token after a failure = %q after %d calls, want a fresh d", got, inner.calls)
+	}
+}
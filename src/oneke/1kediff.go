@@ -0,0 +1,159 @@
+package oneke
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FieldDiff is one field where a test in ThousandEyes isn't what we want it to be
+type FieldDiff struct {
+	Field string
+	Have  interface{}
+	Want  interface{}
+}
+
+func (d FieldDiff) String() string {
+	return fmt.Sprintf("%v: %v -> %v", d.Field, d.Have, d.Want)
+}
+
+// TestDiff is every field that has drifted on a test, empty when it matches
+type TestDiff []FieldDiff
+
+func (d TestDiff) String() string {
+	s := make([]string, 0, len(d))
+	for _, field := range d {
+		s = append(s, field.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// DiffSpecs compares the test we have with the one we want, field by field. Only fields that matter for
+// want's type are looked at. Optional fields we leave to ThousandEyes when they're zero in want (timeouts,
+// status codes and the like) are only compared when want sets them, otherwise ThousandEyes' own defaults
+// would show up as drift every time. Alert rules, labels, headers and the content regex are the same - v6
+// updates leave out empty fields, so we'd never be able to clear them. Agents, alert rules, labels and DNS
+// servers are compared as sets.
+func DiffSpecs(have TestSpec, want TestSpec) TestDiff {
+
+	var diff TestDiff
+
+	str := func(field string, h string, w string) {
+		if h != w {
+			diff = append(diff, FieldDiff{Field: field, Have: h, Want: w})
+		}
+	}
+	optionalStr := func(field string, h string, w string) {
+		if w != "" {
+			str(field, h, w)
+		}
+	}
+	num := func(field string, h int, w int) {
+		if h != w {
+			diff = append(diff, FieldDiff{Field: field, Have: h, Want: w})
+		}
+	}
+	optionalNum := func(field string, h int, w int) {
+		if w != 0 {
+			num(field, h, w)
+		}
+	}
+	flag := func(field string, h bool, w bool) {
+		if h != w {
+			diff = append(diff, FieldDiff{Field: field, Have: h, Want: w})
+		}
+	}
+	set := func(field string, h []string, w []string) {
+		if !sameSet(h, w) {
+			diff = append(diff, FieldDiff{Field: field, Have: h, Want: w})
+		}
+	}
+	optionalSet := func(field string, h []string, w []string) {
+		if len(w) > 0 {
+			set(field, h, w)
+		}
+	}
+	optionalList := func(field string, h []string, w []string) {
+		if len(w) > 0 && strings.Join(h, "\n") != strings.Join(w, "\n") {
+			diff = append(diff, FieldDiff{Field: field, Have: h, Want: w})
+		}
+	}
+
+	str("name", have.Name, want.Name)
+	num("interval", have.Interval, want.Interval)
+	set("agents", have.AgentIDs, want.AgentIDs)
+	flag("alertsEnabled", have.AlertsEnabled, want.AlertsEnabled)
+	optionalSet("alertRules", have.AlertRuleIDs, want.AlertRuleIDs)
+	optionalSet("labels", have.LabelIDs, want.LabelIDs)
+
+	switch want.Type {
+	case TestTypeHTTPServer, TestTypePageLoad, TestTypeAPI:
+		str("url", have.URL, want.URL)
+		optionalNum("timeoutMs", have.TimeoutMs, want.TimeoutMs)
+		optionalList("headers", normalizeHeaders(have.Headers), normalizeHeaders(want.Headers))
+		flag("verifyCertificate", have.VerifyCertificate, want.VerifyCertificate)
+		flag("networkMeasurements", have.NetworkMeasurements, want.NetworkMeasurements)
+		if want.Type != TestTypeAPI {
+			flag("bgpMeasurements", have.BGPMeasurements, want.BGPMeasurements)
+		}
+		switch want.Type {
+		case TestTypeHTTPServer:
+			optionalStr("contentRegex", have.ContentRegex, want.ContentRegex)
+			optionalNum("expectedStatusCode", have.ExpectedStatusCode, want.ExpectedStatusCode)
+		case TestTypePageLoad:
+			optionalNum("pageLoadInterval", have.PageLoadInterval, want.PageLoadInterval)
+		case TestTypeAPI:
+			optionalNum("expectedStatusCode", have.ExpectedStatusCode, want.ExpectedStatusCode)
+			optionalStr("method", strings.ToUpper(have.Method), strings.ToUpper(want.Method))
+			str("requestBody", have.RequestBody, want.RequestBody)
+		}
+
+	case TestTypeAgentToServer:
+		str("server", have.Server, want.Server)
+		optionalNum("port", have.Port, want.Port)
+		optionalStr("protocol", have.Protocol, want.Protocol)
+		flag("bgpMeasurements", have.BGPMeasurements, want.BGPMeasurements)
+
+	case TestTypeDNSServer:
+		str("domain", have.Domain, want.Domain)
+		set("dnsServers", have.DNSServers, want.DNSServers)
+		flag("bgpMeasurements", have.BGPMeasurements, want.BGPMeasurements)
+
+	case TestTypeDNSTrace:
+		str("domain", have.Domain, want.Domain)
+	}
+
+	return diff
+}
+
+// normalizeHeaders writes every "Name:value" header as "Name: value", the way v7 api tests read back
+func normalizeHeaders(headers []string) []string {
+	if headers == nil {
+		return nil
+	}
+	normalized := make([]string, 0, len(headers))
+	for _, header := range headers {
+		if s := strings.SplitN(header, ":", 2); len(s) == 2 {
+			header = strings.TrimSpace(s[0]) + ": " + strings.TrimSpace(s[1])
+		}
+		normalized = append(normalized, header)
+	}
+	return normalized
+}
+
+// sameSet is true when a and b hold the same strings, ignoring order
+func sameSet(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
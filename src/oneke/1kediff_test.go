@@ -0,0 +1,83 @@
+package oneke
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffSpecs(t *testing.T) {
+
+	base := TestSpec{
+		Name:          "abc - standard",
+		Type:          TestTypeHTTPServer,
+		Interval:      60,
+		AgentIDs:      []string{"1", "2"},
+		AlertsEnabled: true,
+		URL:           "https://abc.companycloud.com/login",
+	}
+
+	// what ThousandEyes gives back for a test someone has added to since we made it
+	added := base
+	added.AlertRuleIDs = []string{"99"}
+	added.LabelIDs = []string{"7"}
+	added.Headers = []string{"X: y"}
+	added.ContentRegex = "old"
+	added.TimeoutMs = 5000
+	added.ExpectedStatusCode = 200
+
+	with := func(change func(*TestSpec)) TestSpec {
+		spec := base
+		change(&spec)
+		return spec
+	}
+
+	tests := []struct {
+		name   string
+		have   TestSpec
+		want   TestSpec
+		fields []string
+	}{
+		{"same", base, base, nil},
+		{"agents in another order", with(func(s *TestSpec) { s.AgentIDs = []string{"2", "1"} }), base, nil},
+		{"fields the template leaves empty are left alone", added, base, nil},
+		{"interval and name", with(func(s *TestSpec) { s.Interval = 300; s.Name = "old" }), base, []string{"name", "interval"}},
+		{"agents", with(func(s *TestSpec) { s.AgentIDs = []string{"1"} }), base, []string{"agents"}},
+		{"alerts turned off", with(func(s *TestSpec) { s.AlertsEnabled = false }), base, []string{"alertsEnabled"}},
+		{"alert rules when the template has some", added, with(func(s *TestSpec) { s.AlertRuleIDs = []string{"100"} }), []string{"alertRules"}},
+		{"headers when the template has some", added, with(func(s *TestSpec) { s.Headers = []string{"X: z"} }), []string{"headers"}},
+		{"content regex when the template has one", added, with(func(s *TestSpec) { s.ContentRegex = "new" }), []string{"contentRegex"}},
+		{"timeout when the template has one", added, with(func(s *TestSpec) { s.TimeoutMs = 10000 }), []string{"timeoutMs"}},
+		{"fields for other types are ignored", with(func(s *TestSpec) { s.Domain = "example.com" }), base, nil},
+		{
+			"dns servers",
+			TestSpec{Type: TestTypeDNSServer, Domain: "example.com", DNSServers: []string{"a", "b"}},
+			TestSpec{Type: TestTypeDNSServer, Domain: "example.com", DNSServers: []string{"b", "c"}},
+			[]string{"dnsServers"},
+		},
+		{
+			"api headers as they read back",
+			TestSpec{Type: TestTypeAPI, URL: "https://abc", Headers: []string{"X-Foo: bar"}, TimeoutMs: 5000},
+			TestSpec{Type: TestTypeAPI, URL: "https://abc", Headers: []string{"X-Foo:bar"}, TimeoutMs: 5000},
+			nil,
+		},
+		{
+			"api method case",
+			TestSpec{Type: TestTypeAPI, URL: "https://abc", Method: "post"},
+			TestSpec{Type: TestTypeAPI, URL: "https://abc", Method: "POST"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := DiffSpecs(tt.have, tt.want)
+			var fields []string
+			for _, field := range diff {
+				fields = append(fields, field.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("DiffSpecs = %v, want changes to %v", diff, tt.fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package oneke
+
+import "context"
+
+type dryRunKey struct{}
+
+// WithDryRun marks everything done with ctx as a dry run. Calls that would change something in ThousandEyes
+// (creating, updating and deleting tests, labels and alert rules) log what they would have done and carry
+// on as if they had, reads still go through so plans are built from the real account. Anything that slips
+// past that gets ErrDryRun rather than being sent.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// IsDryRun reports whether ctx was marked with WithDryRun
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// dryRunID stands in for the ID of something a dry run pretended to create
+func dryRunID(name string) string {
+	return "dry-run:" + name
+}
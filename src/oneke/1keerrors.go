@@ -0,0 +1,181 @@
+package oneke
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors - check for these with errors.Is, or use errors.As to get at the typed error underneath
+var (
+	// ErrTransport means we never got a response out of ThousandEyes
+	ErrTransport = errors.New("oneke: transport error")
+	// ErrAuth means we couldn't get credentials or ThousandEyes rejected the ones we sent
+	ErrAuth = errors.New("oneke: authentication error")
+	// ErrAPI means ThousandEyes answered with a 4xx or 5xx
+	ErrAPI = errors.New("oneke: api error")
+	// ErrDecode means ThousandEyes answered but we couldn't make sense of the body
+	ErrDecode = errors.New("oneke: decode error")
+	// ErrDryRun means a request that would have changed something was stopped because of WithDryRun
+	ErrDryRun = errors.New("oneke: not sent, dry run")
+
+	// ErrSecretNotFound means the secret holding the credentials doesn't exist
+	ErrSecretNotFound = errors.New("oneke: secret not found")
+	// ErrSecretDecryption means Secrets Manager couldn't decrypt the secret with its KMS key
+	ErrSecretDecryption = errors.New("oneke: unable to decrypt secret")
+	// ErrMalformedSecret means we got the secret but it isn't laid out the way we expect
+	ErrMalformedSecret = errors.New("oneke: malformed secret")
+	// ErrMissingUser means the credentials don't have the user Basic auth needs
+	ErrMissingUser = errors.New("oneke: credentials have no user")
+	// ErrMissingToken means the credentials don't have an API or bearer token
+	ErrMissingToken = errors.New("oneke: credentials have no token")
+)
+
+// TransportError is returned when a request can't be built or sent
+type TransportError struct {
+	Method   string
+	Endpoint string
+	Err      error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("oneke: %v %v failed: %v", e.Method, e.Endpoint, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// Is lets TransportError match ErrTransport
+func (e *TransportError) Is(target error) bool { return target == ErrTransport }
+
+// AuthError is returned when the credentials provider fails
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("oneke: unable to retrieve credentials: %v", e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// Is lets AuthError match ErrAuth
+func (e *AuthError) Is(target error) bool { return target == ErrAuth }
+
+// CredentialsError says what went wrong getting credentials out of a source. Kind is one of the
+// ErrSecret*/ErrMalformedSecret/ErrMissing* sentinels and Err the underlying cause, if there was one.
+type CredentialsError struct {
+	Source string
+	Kind   error
+	Err    error
+}
+
+func (e *CredentialsError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v (%v)", e.Kind, e.Source)
+	}
+	return fmt.Sprintf("%v (%v): %v", e.Kind, e.Source, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *CredentialsError) Unwrap() error { return e.Err }
+
+// Is lets CredentialsError match its Kind, and ErrAuth as it always means we can't authenticate
+func (e *CredentialsError) Is(target error) bool { return target == e.Kind || target == ErrAuth }
+
+// APIError is returned when ThousandEyes answers with a non-2xx status. Message is pulled out of the error
+// envelope when there is one, Body holds whatever came back.
+type APIError struct {
+	Status   int
+	Message  string
+	Endpoint string
+	Body     []byte
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	return fmt.Sprintf("oneke: %v returned %d: %v", e.Endpoint, e.Status, msg)
+}
+
+// Is lets APIError match ErrAPI, and ErrAuth too for 401s and 403s
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrAPI:
+		return true
+	case ErrAuth:
+		return e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden
+	}
+	return false
+}
+
+// DecodeError is returned when a response body isn't the JSON we expected
+type DecodeError struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("oneke: unable to decode response from %v: %v", e.Endpoint, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// Is lets DecodeError match ErrDecode
+func (e *DecodeError) Is(target error) bool { return target == ErrDecode }
+
+// onekeErrorEnvelope covers the shapes ThousandEyes uses for error bodies - v6 sends errorMessage, the
+// newer endpoints send RFC 7807 style title/detail and the OAuth side sends error/error_description
+type onekeErrorEnvelope struct {
+	ErrorMessage     string `json:"errorMessage,omitempty"`
+	Message          string `json:"message,omitempty"`
+	Title            string `json:"title,omitempty"`
+	Detail           string `json:"detail,omitempty"`
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// message picks the most useful thing the envelope has to say
+func (e onekeErrorEnvelope) message() string {
+	switch {
+	case e.ErrorMessage != "":
+		return e.ErrorMessage
+	case e.Detail != "" && e.Title != "":
+		return e.Title + ": " + e.Detail
+	case e.Detail != "":
+		return e.Detail
+	case e.Title != "":
+		return e.Title
+	case e.Message != "":
+		return e.Message
+	case e.ErrorDescription != "":
+		return e.ErrorDescription
+	}
+	return e.Error
+}
+
+// checkResponse turns a non-2xx response into an *APIError
+func checkResponse(resp *http.Response, body []byte, endpoint string) error {
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+
+	apiErr := &APIError{Status: resp.StatusCode, Endpoint: endpoint, Body: body}
+
+	var envelope onekeErrorEnvelope
+	if err := json.Unmarshal(body, &envelope); err == nil {
+		apiErr.Message = envelope.message()
+	} else if len(body) > 0 && len(body) < 512 {
+		// not JSON, probably a load balancer page - short ones are still worth showing
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return apiErr
+}
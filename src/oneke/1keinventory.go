@@ -0,0 +1,192 @@
+package oneke
+
+// Inventory is a set of tests indexed every way the reconciler needs to look them up - by ID, target
+// (the URL, host or domain), owning stack, type, and type plus target together. Any number of tests can
+// share a target, nothing gets overwritten.
+//
+// The zero value isn't usable, make one with NewInventory.
+type Inventory struct {
+	tests map[string]Test
+	order []string
+
+	byTarget map[string][]string
+	byStack  map[string][]string
+	byType   map[string][]string
+	byKey    map[string][]string
+}
+
+// NewInventory builds an inventory holding tests
+func NewInventory(tests ...Test) *Inventory {
+	inv := &Inventory{
+		tests:    make(map[string]Test),
+		byTarget: make(map[string][]string),
+		byStack:  make(map[string][]string),
+		byType:   make(map[string][]string),
+		byKey:    make(map[string][]string),
+	}
+	for _, test := range tests {
+		inv.Add(test)
+	}
+	return inv
+}
+
+// Add puts a test in the inventory, replacing any test with the same ID
+func (inv *Inventory) Add(test Test) {
+
+	if _, ok := inv.tests[test.ID]; ok {
+		inv.Remove(test.ID)
+	}
+
+	inv.tests[test.ID] = test
+	inv.order = append(inv.order, test.ID)
+
+	inv.byTarget[test.Target()] = append(inv.byTarget[test.Target()], test.ID)
+	inv.byType[test.Type] = append(inv.byType[test.Type], test.ID)
+	inv.byKey[TestKey(test.Type, test.Target())] = append(inv.byKey[TestKey(test.Type, test.Target())], test.ID)
+	if stack := test.Stack(); stack != "" {
+		inv.byStack[stack] = append(inv.byStack[stack], test.ID)
+	}
+}
+
+// Remove takes a test out of the inventory, returning false if it wasn't there
+func (inv *Inventory) Remove(id string) bool {
+
+	test, ok := inv.tests[id]
+	if !ok {
+		return false
+	}
+
+	delete(inv.tests, id)
+	inv.order = without(inv.order, id)
+	removeFrom(inv.byTarget, test.Target(), id)
+	removeFrom(inv.byType, test.Type, id)
+	removeFrom(inv.byKey, TestKey(test.Type, test.Target()), id)
+	removeFrom(inv.byStack, test.Stack(), id)
+
+	return true
+}
+
+// Len is how many tests the inventory holds
+func (inv *Inventory) Len() int {
+	return len(inv.tests)
+}
+
+// All returns every test in the order they were added
+func (inv *Inventory) All() []Test {
+	return inv.lookup(inv.order)
+}
+
+// ByID returns the test with id
+func (inv *Inventory) ByID(id string) (Test, bool) {
+	test, ok := inv.tests[id]
+	return test, ok
+}
+
+// ByTarget returns the tests pointing at a URL, host or domain, whatever their type
+func (inv *Inventory) ByTarget(target string) []Test {
+	return inv.lookup(inv.byTarget[target])
+}
+
+// ByURL is ByTarget for web tests, which is what most callers are after
+func (inv *Inventory) ByURL(url string) []Test {
+	return inv.ByTarget(url)
+}
+
+// ByStack returns the tests whose names say they belong to stack, use ForStack to apply ownership rules
+func (inv *Inventory) ByStack(stack string) []Test {
+	return inv.lookup(inv.byStack[stack])
+}
+
+// ByType returns the tests of one type
+func (inv *Inventory) ByType(testType string) []Test {
+	return inv.lookup(inv.byType[testType])
+}
+
+// Find returns the tests of testType pointing at target, there should only be one but nothing stops
+// ThousandEyes having several
+func (inv *Inventory) Find(testType string, target string) []Test {
+	return inv.lookup(inv.byKey[TestKey(testType, target)])
+}
+
+// Has reports whether there's a test of testType pointing at target
+func (inv *Inventory) Has(testType string, target string) bool {
+	return len(inv.byKey[TestKey(testType, target)]) > 0
+}
+
+// ForStack is a new inventory of just the tests rules says belong to stack, each with its Ownership
+// explaining why. nil rules means DefaultOwnershipRules.
+func (inv *Inventory) ForStack(stack string, rules *OwnershipRules) *Inventory {
+
+	owned := NewInventory()
+	for _, test := range inv.WithOwnership(stack, rules).All() {
+		if test.Ownership != "" {
+			owned.Add(test)
+		}
+	}
+	return owned
+}
+
+// WithOwnership is a copy of the inventory with Ownership set on the tests rules says belong to stack and
+// cleared on the rest. nil rules means DefaultOwnershipRules.
+func (inv *Inventory) WithOwnership(stack string, rules *OwnershipRules) *Inventory {
+
+	if rules == nil {
+		rules = DefaultOwnershipRules()
+	}
+
+	marked := NewInventory()
+	for _, test := range inv.All() {
+		test.Ownership, _ = rules.Owns(test, stack)
+		marked.Add(test)
+	}
+	return marked
+}
+
+// Owned returns the tests with Ownership set
+func (inv *Inventory) Owned() []Test {
+	var owned []Test
+	for _, test := range inv.All() {
+		if test.Ownership != "" {
+			owned = append(owned, test)
+		}
+	}
+	return owned
+}
+
+// SetDetails records a test's full configuration, returning false if the test isn't in the inventory
+func (inv *Inventory) SetDetails(id string, details TestSpec) bool {
+	test, ok := inv.tests[id]
+	if !ok {
+		return false
+	}
+	test.Details = &details
+	inv.tests[id] = test
+	return true
+}
+
+func (inv *Inventory) lookup(ids []string) []Test {
+	tests := make([]Test, 0, len(ids))
+	for _, id := range ids {
+		tests = append(tests, inv.tests[id])
+	}
+	return tests
+}
+
+func removeFrom(index map[string][]string, key string, id string) {
+	ids := without(index[key], id)
+	if len(ids) == 0 {
+		delete(index, key)
+		return
+	}
+	index[key] = ids
+}
+
+func without(ids []string, id string) []string {
+	out := make([]string, 0, len(ids))
+	for _, other := range ids {
+		if other != id {
+			out = append(out, other)
+		}
+	}
+	return out
+}
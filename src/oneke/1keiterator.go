@@ -0,0 +1,133 @@
+package oneke
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// onekePages is the pagination block ThousandEyes adds to list responses on big accounts
+type onekePages struct {
+	Current int    `json:"current,omitempty"`
+	Next    string `json:"next,omitempty"`
+}
+
+// TestIterator walks every test in the account a page at a time, so callers can stream through them
+// instead of holding the lot in memory. Use it like bufio.Scanner:
+//
+//	it := client.ListTests(ctx)
+//	for it.Next() {
+//		test := it.Test()
+//	}
+//	err := it.Err()
+type TestIterator struct {
+	ctx    context.Context
+	client *Client
+	fetch  pageFetcher
+
+	next    string
+	visited map[string]bool
+	page    []Test
+	current Test
+	started bool
+	err     error
+}
+
+// pageFetcher grabs one page of tests from an endpoint and returns the link to the page after it, if any.
+// Each API version supplies its own.
+type pageFetcher func(ctx context.Context, endpoint string) ([]Test, string, error)
+
+func newTestIterator(ctx context.Context, client *Client, first string, fetch pageFetcher) *TestIterator {
+	return &TestIterator{ctx: ctx, client: client, fetch: fetch, next: first, visited: make(map[string]bool)}
+}
+
+// ListTests returns an iterator over every test in the account, following pagination links until
+// ThousandEyes says there are no more
+func (c *Client) ListTests(ctx context.Context) *TestIterator {
+	c.logger.Printf("ListTests called...\n")
+	return c.api.ListTests(ctx)
+}
+
+// Next moves on to the next test, fetching another page if needed. It returns false when we've run out
+// of tests or hit an error - check Err to find out which.
+func (it *TestIterator) Next() bool {
+
+	for len(it.page) == 0 {
+		if it.err != nil || (it.started && it.next == "") {
+			return false
+		}
+		it.fetchNext()
+	}
+
+	it.current = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+// Test returns the test Next just moved on to
+func (it *TestIterator) Test() Test {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *TestIterator) Err() error {
+	return it.err
+}
+
+// fetchNext grabs the page it.next points at and works out where the one after it lives
+func (it *TestIterator) fetchNext() {
+
+	endpoint := it.next
+	it.started = true
+	it.next = ""
+	it.visited[endpoint] = true
+
+	tests, next, err := it.fetch(it.ctx, endpoint)
+	if err != nil {
+		it.err = fmt.Errorf("listing tests: %w", err)
+		return
+	}
+	it.page = append(it.page, tests...)
+
+	if next != "" {
+		next, err := it.client.relativeEndpoint(next)
+		if err != nil {
+			it.err = err
+			return
+		}
+		// a link back to any page we've already had would go round forever
+		if it.visited[next] {
+			it.err = &DecodeError{Endpoint: endpoint, Err: fmt.Errorf("next page link %v points back at a page we've already had", next)}
+			return
+		}
+		it.next = next
+	}
+}
+
+// relativeEndpoint turns an absolute link from ThousandEyes back into an endpoint under our base URL.
+// We won't follow links anywhere else as they'd get our credentials.
+func (c *Client) relativeEndpoint(link string) (string, error) {
+
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return "", err
+	}
+	target, err := base.Parse(link)
+	if err != nil {
+		return "", &DecodeError{Endpoint: link, Err: err}
+	}
+
+	// /v7foo isn't under /v7
+	under := target.Path == base.Path || strings.HasPrefix(target.Path, strings.TrimSuffix(base.Path, "/")+"/")
+	if target.Host != base.Host || !under {
+		return "", &DecodeError{Endpoint: link, Err: fmt.Errorf("link is outside %v", c.baseURL)}
+	}
+
+	endpoint := strings.TrimPrefix(target.Path, base.Path)
+	if target.RawQuery != "" {
+		endpoint += "?" + target.RawQuery
+	}
+
+	return endpoint, nil
+}
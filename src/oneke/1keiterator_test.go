@@ -0,0 +1,61 @@
+package oneke
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTestIteratorStopsOnCycle(t *testing.T) {
+
+	c := NewClient(WithBaseURL("https://api.example.com/v7"))
+
+	// A links to B, and B back to A
+	pages := map[string]string{
+		"/tests?page=a": "https://api.example.com/v7/tests?page=b",
+		"/tests?page=b": "https://api.example.com/v7/tests?page=a",
+	}
+	fetches := 0
+	fetch := func(ctx context.Context, endpoint string) ([]Test, string, error) {
+		fetches++
+		return []Test{{ID: endpoint}}, pages[endpoint], nil
+	}
+
+	it := newTestIterator(context.Background(), c, "/tests?page=a", fetch)
+	count := 0
+	for it.Next() {
+		count++
+	}
+
+	if !errors.Is(it.Err(), ErrDecode) {
+		t.Errorf("Err = %v, want ErrDecode", it.Err())
+	}
+	if fetches != 2 || count != 2 {
+		t.Errorf("fetched %d pages and %d tests, want 2 of each", fetches, count)
+	}
+}
+
+func TestRelativeEndpoint(t *testing.T) {
+
+	c := NewClient(WithBaseURL("https://api.example.com/v7"))
+
+	tests := []struct {
+		link string
+		want string
+		ok   bool
+	}{
+		{"https://api.example.com/v7/tests?page=2", "/tests?page=2", true},
+		{"/v7/tests", "/tests", true},
+		{"https://api.example.com/v7", "", true},
+		{"https://api.example.com/v7foo/tests", "", false},
+		{"https://api.example.com/v6/tests", "", false},
+		{"https://elsewhere.example.com/v7/tests", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := c.relativeEndpoint(tt.link)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("relativeEndpoint(%q) = %q, %v, want %q", tt.link, got, err, tt.want)
+		}
+	}
+}
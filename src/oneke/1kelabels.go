@@ -0,0 +1,124 @@
+package oneke
+
+import (
+	"context"
+	"fmt"
+)
+
+// Label is a ThousandEyes test label, or group as v6 calls it
+type Label struct {
+	ID   string
+	Name string
+}
+
+// Prefixes for the labels we put on every test we create, so the ThousandEyes UI groups them by stack and
+// tier and OwnershipRules.LabelPrefix can find a stack's tests
+const (
+	StackLabelPrefix = "stack:"
+	TierLabelPrefix  = "tier:"
+)
+
+// StackLabel is the name of the label for a stack's tests
+func StackLabel(stack string) string {
+	return StackLabelPrefix + stack
+}
+
+// TierLabel is the name of the label for an environment tier's tests
+func TierLabel(tier string) string {
+	return TierLabelPrefix + tier
+}
+
+// ListLabels returns every test label in the account
+func (c *Client) ListLabels(ctx context.Context) ([]Label, error) {
+	c.logger.Printf("ListLabels called...\n")
+	labels, err := c.api.ListLabels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing labels: %w", err)
+	}
+	return labels, nil
+}
+
+// EnsureLabel finds the label called name, creating it if there isn't one. Labels are remembered until
+// ResetCaches so we only go looking once a run.
+func (c *Client) EnsureLabel(ctx context.Context, name string) (Label, error) {
+
+	c.labelsMu.Lock()
+	defer c.labelsMu.Unlock()
+
+	if label, ok := c.labels[name]; ok {
+		return label, nil
+	}
+
+	// fill the cache from ThousandEyes the first time, and again on a miss in case someone else made it
+	labels, err := c.ListLabels(ctx)
+	if err != nil {
+		return Label{}, err
+	}
+	if c.labels == nil {
+		c.labels = make(map[string]Label)
+	}
+	for _, label := range labels {
+		c.labels[label.Name] = label
+	}
+	if label, ok := c.labels[name]; ok {
+		return label, nil
+	}
+
+	// pretend, without remembering it, so the plan still shows the label going on
+	if IsDryRun(ctx) {
+		c.logger.Printf("Dry run - not creating Label: %v\n", name)
+		return Label{ID: dryRunID(name), Name: name}, nil
+	}
+
+	c.logger.Printf("Creating Label: %v\n", name)
+	label, err := c.api.CreateLabel(ctx, name)
+	if err != nil {
+		return Label{}, fmt.Errorf("creating label %v: %w", name, err)
+	}
+	c.labels[name] = label
+	return label, nil
+}
+
+// TestsWithLabel returns the tests carrying the label called name, an empty inventory if there's no such
+// label
+func (c *Client) TestsWithLabel(ctx context.Context, name string) (*Inventory, error) {
+
+	labels, err := c.ListLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, label := range labels {
+		if label.Name != name {
+			continue
+		}
+		tests, err := c.api.LabelTests(ctx, label.ID)
+		if err != nil {
+			return nil, fmt.Errorf("listing tests for label %v: %w", name, err)
+		}
+		return NewInventory(tests...), nil
+	}
+
+	return NewInventory(), nil
+}
+
+// LabelIDsFor finds or creates the stack and tier labels for a test. A label we can't sort out is logged
+// and left off rather than stopping the test being created, the next sync will try again.
+func (c *Client) LabelIDsFor(ctx context.Context, stack string, tier string) []string {
+
+	names := []string{StackLabel(stack)}
+	if tier != "" {
+		names = append(names, TierLabel(tier))
+	}
+
+	var ids []string
+	for _, name := range names {
+		label, err := c.EnsureLabel(ctx, name)
+		if err != nil {
+			c.logger.Printf("Unable to label test with %v - %v\n", name, err)
+			continue
+		}
+		ids = append(ids, label.ID)
+	}
+	return ids
+}
@@ -0,0 +1,105 @@
+package oneke
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrNotOurTestName means a test's name isn't one we built, so it isn't ours to reconcile
+var ErrNotOurTestName = errors.New("oneke: not a reconciler test name")
+
+// TestNameVersion is the name format Build uses when TestName.Version isn't set. Version 1 is the format
+// we've always used, which dashboards and alerts already parse, so it stays the default until they can
+// cope with something else.
+const TestNameVersion = 1
+
+// TestName is what we pack into a test's name so we can tell later which stack it belongs to and what it
+// checks. Build and ParseTestName round trip:
+//
+//	stack=something id=standard metric=web_check testname=web_check~https://something.companycloud.com/...
+//
+// Later versions start with a "v=<version> " marker, names without one are version 1.
+type TestName struct {
+	Version int
+	Stack   string
+	ID      string
+	Metric  string
+	Target  string
+}
+
+// NewTestName is the name for a test of testType on target, built from a stack's terraform id
+func NewTestName(stack string, id string, testType string, target string) TestName {
+	return TestName{
+		Version: TestNameVersion,
+		Stack:   stack,
+		ID:      id,
+		Metric:  metricFor(testType),
+		Target:  target,
+	}
+}
+
+// Build turns the name into the string we give ThousandEyes
+func (n TestName) Build() (string, error) {
+
+	if n.Stack == "" || n.Metric == "" || n.Target == "" {
+		return "", fmt.Errorf("oneke: test name needs a stack, metric and target")
+	}
+	// the stack, id and metric are space separated so can't have spaces of their own, the target is last
+	// so it can
+	if strings.ContainsAny(n.Stack+n.ID+n.Metric, " \t\n~") {
+		return "", fmt.Errorf("oneke: test name stack %q, id %q and metric %q can't contain spaces or ~", n.Stack, n.ID, n.Metric)
+	}
+
+	switch n.Version {
+	case 0, 1:
+		return "stack=" + n.Stack + " id=" + n.ID + " metric=" + n.Metric + " testname=" + n.Metric + "~" + n.Target, nil
+	}
+	return "", fmt.Errorf("oneke: unknown test name version %d", n.Version)
+}
+
+// String is Build without the error, for logging
+func (n TestName) String() string {
+	s, err := n.Build()
+	if err != nil {
+		return fmt.Sprintf("%#v", n)
+	}
+	return s
+}
+
+var (
+	testNameVersion = regexp.MustCompile(`^v=(\d+) `)
+	testNameV1      = regexp.MustCompile(`^stack=(\S+) id=(\S*) metric=(\S+) testname=([^~\s]+)~(.+)$`)
+)
+
+// ParseTestName pulls the parts back out of a test's name. Names we didn't build give ErrNotOurTestName.
+func ParseTestName(s string) (TestName, error) {
+
+	version := 1
+	if m := testNameVersion.FindStringSubmatch(s); m != nil {
+		version, _ = strconv.Atoi(m[1])
+		s = s[len(m[0]):]
+	}
+
+	switch version {
+	case 1:
+		m := testNameV1.FindStringSubmatch(s)
+		if m == nil {
+			return TestName{}, ErrNotOurTestName
+		}
+		return TestName{Version: 1, Stack: m[1], ID: m[2], Metric: m[3], Target: m[5]}, nil
+	}
+
+	return TestName{}, fmt.Errorf("%w: unknown version %d", ErrNotOurTestName, version)
+}
+
+// Stack is the stack a test belongs to going by its name, empty if it isn't one of ours
+func (t Test) Stack() string {
+	name, err := ParseTestName(t.Name)
+	if err != nil {
+		return ""
+	}
+	return name.Stack
+}
@@ -0,0 +1,144 @@
+package oneke
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// OwnershipRules decide which tests belong to a stack. A test is the stack's if any rule says so:
+//
+//	{
+//	  "byName": true,
+//	  "domains": {"prod": ["companycloud.com"], "stg": ["stg.companycloud.com"], "dev": ["companyworks.lol"]},
+//	  "hosts": {"bigcustomer": ["status.bigcustomer.example"]},
+//	  "labelPrefix": "stack:"
+//	}
+//
+// byName goes by the stack in a name we built (see TestName). domains lists the suffixes each environment's
+// stacks live under, so stack "something" owns tests pointing at something.companycloud.com but not
+// xsomething.companycloud.com. hosts lists exact hosts for stacks that don't follow the pattern, and
+// labelPrefix owns tests carrying a "<prefix><stack>" label.
+type OwnershipRules struct {
+	ByName      bool                `json:"byName"`
+	Domains     map[string][]string `json:"domains,omitempty"`
+	Hosts       map[string][]string `json:"hosts,omitempty"`
+	LabelPrefix string              `json:"labelPrefix,omitempty"`
+}
+
+// DefaultOwnershipRules only trusts test names and the stack labels CreateTest adds, so nothing we didn't
+// create is ever touched
+func DefaultOwnershipRules() *OwnershipRules {
+	return &OwnershipRules{ByName: true, LabelPrefix: StackLabelPrefix}
+}
+
+// LoadOwnershipRules reads ownership rules from a JSON file
+func LoadOwnershipRules(path string) (*OwnershipRules, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("oneke: unable to read ownership rules: %w", err)
+	}
+
+	var rules OwnershipRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("oneke: unable to parse ownership rules %v: %w", path, err)
+	}
+
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &rules, nil
+}
+
+// Validate makes sure the rules can match something and don't have suffixes that would match everything
+func (r *OwnershipRules) Validate() error {
+
+	if !r.ByName && len(r.Domains) == 0 && len(r.Hosts) == 0 && r.LabelPrefix == "" {
+		return fmt.Errorf("oneke: ownership rules don't match anything")
+	}
+	for env, suffixes := range r.Domains {
+		for _, suffix := range suffixes {
+			if strings.Trim(suffix, ".") == "" {
+				return fmt.Errorf("oneke: ownership domain for %v is empty", env)
+			}
+		}
+	}
+	for stack, hosts := range r.Hosts {
+		for _, host := range hosts {
+			if host == "" {
+				return fmt.Errorf("oneke: ownership host for %v is empty", stack)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Owns reports whether test belongs to stack, and if it does, why
+func (r *OwnershipRules) Owns(test Test, stack string) (string, bool) {
+
+	if stack == "" {
+		return "", false
+	}
+
+	if r.ByName {
+		if name, err := ParseTestName(test.Name); err == nil && name.Stack == stack {
+			return "test name has stack=" + stack, true
+		}
+	}
+
+	host := targetHost(test.Target())
+
+	for _, exact := range r.Hosts[stack] {
+		if strings.EqualFold(host, exact) {
+			return "host " + host + " is listed for " + stack, true
+		}
+	}
+
+	// environments are checked in order so the explanation doesn't change from run to run
+	envs := make([]string, 0, len(r.Domains))
+	for env := range r.Domains {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	for _, env := range envs {
+		for _, suffix := range r.Domains[env] {
+			want := stack + "." + strings.Trim(suffix, ".")
+			if strings.EqualFold(host, want) {
+				return "host " + host + " is " + stack + " under the " + env + " domain " + suffix, true
+			}
+		}
+	}
+
+	if r.LabelPrefix != "" {
+		for _, label := range test.Labels {
+			if label == r.LabelPrefix+stack {
+				return "test has label " + label, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// targetHost gets the host out of a test target, which is a URL for web tests, a host for network tests and
+// a domain, maybe followed by a record type, for DNS tests
+func targetHost(target string) string {
+
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil {
+			return u.Hostname()
+		}
+	}
+
+	if i := strings.IndexAny(target, " /"); i >= 0 {
+		target = target[:i]
+	}
+	return strings.TrimSuffix(target, ".")
+}
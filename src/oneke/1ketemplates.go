@@ -0,0 +1,444 @@
+package oneke
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TestTemplate is a named monitoring profile - everything about a test except its name and what it points
+// at. Type decides which of the type specific fields matter.
+//
+// Agents can be agent IDs or AgentSelectors like "label=prod-monitors" or "region=stack", which an
+// AgentResolver turns into IDs. Every agent the selectors match is used, MinAgents and MinContinents make
+// sure there are enough of them, e.g. at least 3 agents across 2 continents. MaxAgents trims the matches
+// down to that many, spread across as many continents as possible.
+type TestTemplate struct {
+	Name                string   `json:"-"`
+	Type                string   `json:"type,omitempty"`
+	Interval            int      `json:"interval"`
+	Agents              []string `json:"agents"`
+	MinAgents           int      `json:"minAgents,omitempty"`
+	MinContinents       int      `json:"minContinents,omitempty"`
+	MaxAgents           int      `json:"maxAgents,omitempty"`
+	ContentRegex        string   `json:"contentRegex,omitempty"`
+	TimeoutMs           int      `json:"timeoutMs,omitempty"`
+	Headers             []string `json:"headers,omitempty"`
+	ExpectedStatusCode  int      `json:"expectedStatusCode,omitempty"`
+	VerifyCertificate   bool     `json:"verifyCertificate"`
+	AlertsEnabled       bool     `json:"alertsEnabled"`
+	AlertRules          []string `json:"alertRules,omitempty"`
+	BGPMeasurements     bool     `json:"bgpMeasurements"`
+	NetworkMeasurements bool     `json:"networkMeasurements"`
+
+	// page-load, defaults to Interval
+	PageLoadInterval int `json:"pageLoadInterval,omitempty"`
+	// agent-to-server, the port defaults to the URL's
+	Port     int    `json:"port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	// dns-server and dns-trace, the record type is added to the domain when set
+	DNSServers []string `json:"dnsServers,omitempty"`
+	RecordType string   `json:"recordType,omitempty"`
+	// api
+	Method      string `json:"method,omitempty"`
+	RequestBody string `json:"requestBody,omitempty"`
+}
+
+// validIntervals are the only test intervals (in seconds) ThousandEyes accepts
+var validIntervals = map[int]bool{60: true, 120: true, 300: true, 600: true, 900: true, 1800: true, 3600: true}
+
+// Validate checks a template is something ThousandEyes will accept, so we find out before sending it
+func (t TestTemplate) Validate() error {
+
+	var problems []string
+
+	switch t.Type {
+	case TestTypeHTTPServer, TestTypePageLoad, TestTypeDNSTrace:
+	case TestTypeAgentToServer:
+		if t.Port < 0 || t.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("port %d is out of range", t.Port))
+		}
+		if t.Protocol != "" && t.Protocol != "TCP" && t.Protocol != "ICMP" {
+			problems = append(problems, fmt.Sprintf("protocol %q should be TCP or ICMP", t.Protocol))
+		}
+	case TestTypeDNSServer:
+		if len(t.DNSServers) == 0 {
+			problems = append(problems, "dns-server tests need at least one DNS server")
+		}
+	case TestTypeAPI:
+		switch strings.ToUpper(t.Method) {
+		case "", "GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS":
+		default:
+			problems = append(problems, fmt.Sprintf("method %q isn't an HTTP method", t.Method))
+		}
+		// api tests take a time limit in whole seconds
+		if t.TimeoutMs%1000 != 0 {
+			problems = append(problems, fmt.Sprintf("timeout %dms should be a whole number of seconds for api tests", t.TimeoutMs))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported test type %q", t.Type))
+	}
+	if t.PageLoadInterval != 0 && !validIntervals[t.PageLoadInterval] {
+		problems = append(problems, fmt.Sprintf("page load interval %d isn't a valid interval", t.PageLoadInterval))
+	}
+	if !validIntervals[t.Interval] {
+		problems = append(problems, fmt.Sprintf("interval %d isn't one of 60, 120, 300, 600, 900, 1800 or 3600", t.Interval))
+	}
+	if len(t.Agents) == 0 {
+		problems = append(problems, "no agents")
+	}
+	for _, agent := range t.Agents {
+		if _, err := ParseAgentSelector(agent); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if t.MinAgents < 0 || t.MinContinents < 0 || (t.MinContinents > t.MinAgents && t.MinAgents > 0) {
+		problems = append(problems, fmt.Sprintf("can't have %d agents across %d continents", t.MinAgents, t.MinContinents))
+	}
+	if t.MaxAgents < 0 || (t.MaxAgents > 0 && (t.MaxAgents < t.MinAgents || t.MaxAgents < t.MinContinents)) {
+		problems = append(problems, fmt.Sprintf("max agents %d is less than min agents %d or min continents %d", t.MaxAgents, t.MinAgents, t.MinContinents))
+	}
+	if t.ContentRegex != "" {
+		if _, err := regexp.Compile(t.ContentRegex); err != nil {
+			problems = append(problems, fmt.Sprintf("content regex doesn't compile: %v", err))
+		}
+	}
+	if t.TimeoutMs < 0 || t.TimeoutMs > 60000 {
+		problems = append(problems, fmt.Sprintf("timeout %dms should be between 0 and 60000", t.TimeoutMs))
+	}
+	for _, header := range t.Headers {
+		if !strings.Contains(header, ":") || strings.ContainsAny(header, "\r\n") {
+			problems = append(problems, fmt.Sprintf("header %q should look like \"Name: value\"", header))
+		}
+	}
+	if t.ExpectedStatusCode != 0 && (t.ExpectedStatusCode < 100 || t.ExpectedStatusCode > 599) {
+		problems = append(problems, fmt.Sprintf("expected status code %d isn't an HTTP status", t.ExpectedStatusCode))
+	}
+	if len(t.AlertRules) > 0 && !t.AlertsEnabled {
+		problems = append(problems, "alert rules are set but alerts are disabled")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("oneke: template %q: %v", t.Name, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Spec fills in a TestSpec from the template for a particular test name and stack URL. Network and DNS
+// tests point at the URL's host rather than the URL itself.
+func (t TestTemplate) Spec(name string, testURL string) TestSpec {
+
+	spec := TestSpec{
+		Name:                name,
+		Type:                t.Type,
+		Interval:            t.Interval,
+		AgentIDs:            t.Agents,
+		AlertsEnabled:       t.AlertsEnabled,
+		AlertRuleIDs:        t.AlertRules,
+		BGPMeasurements:     t.BGPMeasurements,
+		NetworkMeasurements: t.NetworkMeasurements,
+	}
+
+	host, port := hostAndPort(testURL)
+
+	switch t.Type {
+	case TestTypeAgentToServer:
+		spec.Server = host
+		spec.Port = port
+		if t.Port != 0 {
+			spec.Port = t.Port
+		}
+		spec.Protocol = t.Protocol
+
+	case TestTypeDNSServer, TestTypeDNSTrace:
+		spec.Domain = host
+		if t.RecordType != "" {
+			spec.Domain += " " + t.RecordType
+		}
+		spec.DNSServers = t.DNSServers
+
+	default:
+		spec.URL = testURL
+		spec.ContentRegex = t.ContentRegex
+		spec.TimeoutMs = t.TimeoutMs
+		spec.Headers = t.Headers
+		spec.ExpectedStatusCode = t.ExpectedStatusCode
+		spec.VerifyCertificate = t.VerifyCertificate
+		spec.Method = t.Method
+		spec.RequestBody = t.RequestBody
+		if t.Type == TestTypePageLoad {
+			spec.PageLoadInterval = t.PageLoadInterval
+			if spec.PageLoadInterval == 0 {
+				spec.PageLoadInterval = t.Interval
+			}
+		}
+	}
+
+	return spec
+}
+
+// usesAgentSelectors is true when the agents need resolving before the template can be used
+func (t TestTemplate) usesAgentSelectors() bool {
+	if t.MinAgents > 0 || t.MinContinents > 0 || t.MaxAgents > 0 {
+		return true
+	}
+	for _, agent := range t.Agents {
+		if strings.Contains(agent, "=") {
+			return true
+		}
+	}
+	return false
+}
+
+// usesStackRegion is true when one of the agent selectors wants agents near the stack's own region
+func (t TestTemplate) usesStackRegion() bool {
+	for _, agent := range t.Agents {
+		if sel, err := ParseAgentSelector(agent); err == nil && sel.Terms["region"] == "stack" {
+			return true
+		}
+	}
+	return false
+}
+
+// Target is what a test built from this template for testURL would point at
+func (t TestTemplate) Target(testURL string) string {
+	return t.Spec("", testURL).Target()
+}
+
+// hostAndPort pulls the host out of a URL along with its port, filling in the scheme's default
+func hostAndPort(testURL string) (string, int) {
+
+	u, err := url.Parse(testURL)
+	if err != nil || u.Host == "" {
+		return testURL, 0
+	}
+
+	port, _ := strconv.Atoi(u.Port())
+	if port == 0 {
+		port = 80
+		if u.Scheme == "https" {
+			port = 443
+		}
+	}
+
+	return u.Hostname(), port
+}
+
+// TemplateNames is one or more template names. Config can give either a single name or a list, a stack
+// that wants several kinds of test for each URL lists a template per kind.
+type TemplateNames []string
+
+// UnmarshalJSON accepts "name" as well as ["name", ...]
+func (n *TemplateNames) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case string:
+		*n = TemplateNames{v}
+		return nil
+	case []interface{}:
+		var names []string
+		if err := json.Unmarshal(data, &names); err != nil {
+			return err
+		}
+		*n = names
+		return nil
+	case nil:
+		*n = nil
+		return nil
+	}
+	return fmt.Errorf("template names should be a string or a list of strings")
+}
+
+// TemplateConfig is a catalogue of templates plus the rules for which ones a stack gets. A stack-specific
+// entry wins over the stack's environment tier, which wins over Default. Each can name one template or
+// several, in which case every URL gets a test from each of them.
+//
+//	{
+//	  "default": "standard",
+//	  "tiers": {"prod": ["prod-web", "prod-login-page", "prod-network"]},
+//	  "stacks": {"bigcustomer": "prod-web-eu"},
+//	  "templates": {
+//	    "standard": {"type": "http-server", "interval": 60, "agents": ["14410"]},
+//	    ...
+//	  },
+//	  "alertRules": {
+//	    "http-availability": {"type": "http-server", "expression": "((errorType != \"None\"))", ...},
+//	    ...
+//	  },
+//	  "tierAlertRules": {"prod": ["http-availability"]}
+//	}
+//
+// alertRules is a catalogue of AlertRules and tierAlertRules says which of them each tier's tests get, so
+// prod can page while stg, with no rules, stays quiet.
+type TemplateConfig struct {
+	Default        TemplateNames            `json:"default"`
+	Tiers          map[string]TemplateNames `json:"tiers,omitempty"`
+	Stacks         map[string]TemplateNames `json:"stacks,omitempty"`
+	Templates      map[string]TestTemplate  `json:"templates"`
+	AlertRules     map[string]AlertRule     `json:"alertRules,omitempty"`
+	TierAlertRules map[string][]string      `json:"tierAlertRules,omitempty"`
+}
+
+// DefaultTemplateConfig is what we've always created - one http-server test every 60s from agent 14410
+// with alerts off
+func DefaultTemplateConfig() *TemplateConfig {
+	return &TemplateConfig{
+		Default: TemplateNames{"standard"},
+		Templates: map[string]TestTemplate{
+			"standard": {
+				Name:         "standard",
+				Type:         "http-server",
+				Interval:     60,
+				Agents:       []string{"14410"},
+				ContentRegex: "someregex",
+			},
+		},
+	}
+}
+
+// LoadTemplateConfig reads and validates a template config from a JSON file
+func LoadTemplateConfig(path string) (*TemplateConfig, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("oneke: unable to read template config: %w", err)
+	}
+
+	var tc TemplateConfig
+	if err := json.Unmarshal(data, &tc); err != nil {
+		return nil, fmt.Errorf("oneke: unable to parse template config %v: %w", path, err)
+	}
+
+	for name, tmpl := range tc.Templates {
+		tmpl.Name = name
+		if tmpl.Type == "" {
+			tmpl.Type = "http-server"
+		}
+		tc.Templates[name] = tmpl
+	}
+	for name, rule := range tc.AlertRules {
+		rule.Name = name
+		tc.AlertRules[name] = rule
+	}
+
+	if err := tc.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &tc, nil
+}
+
+// Validate checks every template and that every reference points at one that exists
+func (tc *TemplateConfig) Validate() error {
+
+	names := make([]string, 0, len(tc.Templates))
+	for name := range tc.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := tc.Templates[name].Validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(tc.Default) == 0 {
+		return fmt.Errorf("oneke: no default template")
+	}
+	if err := tc.checkNames("default", tc.Default); err != nil {
+		return err
+	}
+	for tier, names := range tc.Tiers {
+		if err := tc.checkNames("tier "+tier, names); err != nil {
+			return err
+		}
+	}
+	for stack, names := range tc.Stacks {
+		if err := tc.checkNames("stack "+stack, names); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range tc.AlertRules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for tier, names := range tc.TierAlertRules {
+		for _, name := range names {
+			if _, ok := tc.AlertRules[name]; !ok {
+				return fmt.Errorf("oneke: alert rule %q for tier %v doesn't exist", name, tier)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkNames makes sure every name refers to a template, and that no two of them would create the same
+// type of test for a URL
+func (tc *TemplateConfig) checkNames(what string, names TemplateNames) error {
+	types := make(map[string]string)
+	for _, name := range names {
+		tmpl, ok := tc.Templates[name]
+		if !ok {
+			return fmt.Errorf("oneke: template %q for %v doesn't exist", name, what)
+		}
+		if other, ok := types[tmpl.Type]; ok {
+			return fmt.Errorf("oneke: templates %q and %q for %v are both %v tests", other, name, what, tmpl.Type)
+		}
+		types[tmpl.Type] = name
+	}
+	return nil
+}
+
+// Select picks the templates for a stack in the given environment tier
+func (tc *TemplateConfig) Select(stack string, tier string) []TestTemplate {
+
+	names, ok := tc.Stacks[stack]
+	if !ok {
+		names, ok = tc.Tiers[tier]
+	}
+	if !ok {
+		names = tc.Default
+	}
+
+	templates := make([]TestTemplate, 0, len(names))
+	for _, name := range names {
+		templates = append(templates, tc.Templates[name])
+	}
+	return templates
+}
+
+// UsesStackRegion reports whether any template picks agents with region=stack, which needs the stack's
+// region to come from somewhere
+func (tc *TemplateConfig) UsesStackRegion() bool {
+	for _, tmpl := range tc.Templates {
+		if tmpl.usesStackRegion() {
+			return true
+		}
+	}
+	return false
+}
+
+// AlertRulesFor returns the catalogue's alert rules for tier that apply to tests of testType
+func (tc *TemplateConfig) AlertRulesFor(tier string, testType string) []AlertRule {
+
+	var rules []AlertRule
+	for _, name := range tc.TierAlertRules[tier] {
+		if rule := tc.AlertRules[name]; rule.TestType == testType {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
@@ -0,0 +1,30 @@
+package oneke
+
+import "testing"
+
+func TestTemplateValidate(t *testing.T) {
+
+	api := TestTemplate{Name: "api", Type: TestTypeAPI, Interval: 60, Agents: []string{"14410"}}
+
+	tests := []struct {
+		name    string
+		change  func(*TestTemplate)
+		wantErr bool
+	}{
+		{"fine", func(t *TestTemplate) {}, false},
+		{"whole seconds", func(t *TestTemplate) { t.TimeoutMs = 5000 }, false},
+		{"part seconds", func(t *TestTemplate) { t.TimeoutMs = 1500 }, true},
+		{"bad method", func(t *TestTemplate) { t.Method = "FETCH" }, true},
+		{"bad header", func(t *TestTemplate) { t.Headers = []string{"X-Foo"} }, true},
+		{"bad interval", func(t *TestTemplate) { t.Interval = 30 }, true},
+		{"part seconds are fine off api tests", func(t *TestTemplate) { t.Type = TestTypeHTTPServer; t.TimeoutMs = 1500 }, false},
+	}
+
+	for _, tt := range tests {
+		tmpl := api
+		tt.change(&tmpl)
+		if err := tmpl.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%v: Validate = %v", tt.name, err)
+		}
+	}
+}
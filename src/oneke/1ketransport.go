@@ -0,0 +1,280 @@
+package oneke
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ThousandEyes sends these on every response so we know how much of the org's budget is left
+const (
+	rateLimitLimitHeader     = "X-Organization-Rate-Limit-Limit"
+	rateLimitRemainingHeader = "X-Organization-Rate-Limit-Remaining"
+	rateLimitResetHeader     = "X-Organization-Rate-Limit-Reset"
+)
+
+// RetryConfig controls how hard the transport tries before giving up on a request
+type RetryConfig struct {
+	// MaxRetries is how many times a request is retried after the first attempt, 0 turns retries off
+	MaxRetries int
+	// BaseDelay is the backoff for the first retry, it doubles on every attempt after that
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff, and how long we'll wait for a rate limit reset
+	MaxDelay time.Duration
+}
+
+// DefaultRetryConfig is what NewClient uses unless told otherwise with WithRetry
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries: 4,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   60 * time.Second,
+}
+
+// RateLimitTransport is an http.RoundTripper that keeps track of the X-Organization-Rate-Limit-* headers,
+// holds requests back when the budget has run out, and retries on 429s and 5xx with jittered exponential
+// backoff. 429s are retried for any method as ThousandEyes didn't act on the request, 5xx and connection
+// failures only for idempotent ones.
+type RateLimitTransport struct {
+	Base   http.RoundTripper
+	Config RetryConfig
+	Logger *log.Logger
+
+	// now and sleep are swapped out when testing against a server that simulates the limits
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu        sync.Mutex
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+// NewRateLimitTransport wraps base, falling back to http.DefaultTransport when base is nil
+func NewRateLimitTransport(base http.RoundTripper, config RetryConfig) *RateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &RateLimitTransport{
+		Base:      base,
+		Config:    config,
+		now:       time.Now,
+		sleep:     sleepContext,
+		remaining: -1,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+
+		if err := t.waitForBudget(ctx); err != nil {
+			return nil, err
+		}
+
+		attemptReq := req
+		if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+			// The body was used up by the last attempt, we need a fresh copy
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		resp, err := t.Base.RoundTrip(attemptReq)
+		if err == nil {
+			t.observe(resp.Header)
+		}
+
+		if attempt >= t.Config.MaxRetries || !t.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt, resp)
+		if resp != nil {
+			// drain so the connection goes back in the pool
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			t.logf("1ke returned %v for %v %v, retrying in %v (attempt %d of %d)\n", resp.StatusCode, req.Method, req.URL.Path, delay, attempt+1, t.Config.MaxRetries)
+		} else {
+			t.logf("1ke request %v %v failed - %v, retrying in %v (attempt %d of %d)\n", req.Method, req.URL.Path, err, delay, attempt+1, t.Config.MaxRetries)
+		}
+
+		if err := t.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// shouldRetry decides whether a response (or failure) is worth another go
+func (t *RateLimitTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// no way to replay the body
+		return false
+	}
+
+	if err != nil {
+		if req.Context().Err() != nil {
+			return false
+		}
+		return isIdempotent(req)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	return resp.StatusCode >= 500 && isIdempotent(req)
+}
+
+// backoff works out how long to wait before the next attempt. A 429 with a reset header waits for the
+// reset, everything else gets full-jitter exponential backoff.
+func (t *RateLimitTransport) backoff(attempt int, resp *http.Response) time.Duration {
+
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if reset, ok := parseReset(resp.Header); ok {
+			if wait := reset.Sub(t.now()); wait > 0 {
+				return t.capDelay(wait)
+			}
+		}
+		if wait, ok := t.retryAfter(resp.Header); ok {
+			return t.capDelay(wait)
+		}
+	}
+
+	ceiling := t.Config.BaseDelay << uint(attempt)
+	if ceiling <= 0 || ceiling > t.Config.MaxDelay {
+		ceiling = t.Config.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// retryAfter reads Retry-After, which can be a number of seconds or an HTTP date
+func (t *RateLimitTransport) retryAfter(header http.Header) (time.Duration, bool) {
+
+	value := header.Get("Retry-After")
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := at.Sub(t.now()); wait > 0 {
+			return wait, true
+		}
+	}
+	return 0, false
+}
+
+func (t *RateLimitTransport) capDelay(d time.Duration) time.Duration {
+	if t.Config.MaxDelay > 0 && d > t.Config.MaxDelay {
+		return t.Config.MaxDelay
+	}
+	return d
+}
+
+// observe records the rate limit headers from a response
+func (t *RateLimitTransport) observe(header http.Header) {
+
+	remaining, err := strconv.Atoi(header.Get(rateLimitRemainingHeader))
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remaining = remaining
+	if limit, err := strconv.Atoi(header.Get(rateLimitLimitHeader)); err == nil {
+		t.limit = limit
+	}
+	if reset, ok := parseReset(header); ok {
+		t.reset = reset
+	}
+}
+
+// waitForBudget blocks until the rate limit resets if the last response told us we'd used it all up
+func (t *RateLimitTransport) waitForBudget(ctx context.Context) error {
+
+	t.mu.Lock()
+	wait := time.Duration(0)
+	if t.remaining == 0 {
+		wait = t.reset.Sub(t.now())
+	}
+	t.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	wait = t.capDelay(wait)
+	t.logf("1ke rate limit of %d exhausted, waiting %v for the reset\n", t.limit, wait)
+	if err := t.sleep(ctx, wait); err != nil {
+		return err
+	}
+
+	// We don't know what the budget looks like until the next response tells us
+	t.mu.Lock()
+	if t.remaining == 0 {
+		t.remaining = -1
+	}
+	t.mu.Unlock()
+
+	return nil
+}
+
+func (t *RateLimitTransport) logf(format string, v ...interface{}) {
+	if t.Logger != nil {
+		t.Logger.Printf(format, v...)
+	}
+}
+
+// parseReset reads the reset header, which ThousandEyes sends as epoch seconds
+func parseReset(header http.Header) (time.Time, bool) {
+	secs, err := strconv.ParseInt(header.Get(rateLimitResetHeader), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type idempotentKey struct{}
+
+// withIdempotent marks a request as safe to retry even though the method says otherwise - the v6 API
+// deletes with a POST for example
+func withIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	marked, _ := req.Context().Value(idempotentKey{}).(bool)
+	return marked
+}
@@ -0,0 +1,174 @@
+package oneke
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testTransport is a transport that doesn't really sleep, it notes down how long it was asked to wait
+func testTransport(config RetryConfig, now time.Time) (*RateLimitTransport, *[]time.Duration) {
+
+	var waits []time.Duration
+	transport := NewRateLimitTransport(nil, config)
+	transport.now = func() time.Time { return now }
+	transport.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return transport, &waits
+}
+
+// limitedServer answers the first limited requests with a 429 carrying retryAfter, and 200 after that
+func limitedServer(t *testing.T, limited int, retryAfter string) (*httptest.Server, *int) {
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= limited {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func get(t *testing.T, ctx context.Context, transport http.RoundTripper, url string) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if resp != nil {
+		t.Cleanup(func() { resp.Body.Close() })
+	}
+	return resp, err
+}
+
+func TestRateLimitTransportRetryAfter(t *testing.T) {
+
+	now := time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		retryAfter string
+		want       time.Duration
+	}{
+		{"seconds", "7", 7 * time.Second},
+		{"http date", now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{"capped", "3600", time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			server, requests := limitedServer(t, 1, tt.retryAfter)
+			transport, waits := testTransport(RetryConfig{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Minute}, now)
+
+			resp, err := get(t, context.Background(), transport, server.URL)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("RoundTrip = %v, %v, want 200", resp, err)
+			}
+			if *requests != 2 {
+				t.Errorf("server saw %d requests, want 2", *requests)
+			}
+			if len(*waits) != 1 || (*waits)[0] != tt.want {
+				t.Errorf("waited %v, want [%v]", *waits, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitTransportGivesUp(t *testing.T) {
+
+	server, requests := limitedServer(t, 10, "1")
+	transport, waits := testTransport(RetryConfig{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Minute}, time.Now())
+
+	// once the retries are used up the caller gets the last 429
+	resp, err := get(t, context.Background(), transport, server.URL)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("RoundTrip = %v, %v, want 429", resp, err)
+	}
+	if *requests != 3 || len(*waits) != 2 {
+		t.Errorf("server saw %d requests after %d waits, want 3 after 2", *requests, len(*waits))
+	}
+}
+
+func TestRateLimitTransportCancelledDuringBackoff(t *testing.T) {
+
+	server, requests := limitedServer(t, 10, "30")
+	transport := NewRateLimitTransport(nil, RetryConfig{MaxRetries: 4, BaseDelay: time.Millisecond, MaxDelay: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel part way through the 30s wait, the real sleep has to notice
+	transport.sleep = func(ctx context.Context, d time.Duration) error {
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return sleepContext(ctx, d)
+	}
+
+	start := time.Now()
+	_, err := get(t, ctx, transport, server.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RoundTrip error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RoundTrip took %v, it should stop waiting when cancelled", elapsed)
+	}
+	if *requests != 1 {
+		t.Errorf("server saw %d requests, want 1", *requests)
+	}
+}
+
+func TestRateLimitTransportWaitsForBudget(t *testing.T) {
+
+	now := time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		reset time.Duration
+		want  time.Duration
+	}{
+		{"until the reset", 30 * time.Second, 30 * time.Second},
+		{"capped", time.Hour, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// every response says the budget is used up until the reset
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(rateLimitLimitHeader, "240")
+				w.Header().Set(rateLimitRemainingHeader, "0")
+				w.Header().Set(rateLimitResetHeader, strconv.FormatInt(now.Add(tt.reset).Unix(), 10))
+				w.WriteHeader(http.StatusOK)
+			}))
+			t.Cleanup(server.Close)
+
+			transport, waits := testTransport(RetryConfig{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Minute}, now)
+
+			if _, err := get(t, context.Background(), transport, server.URL); err != nil {
+				t.Fatal(err)
+			}
+			if len(*waits) != 0 {
+				t.Fatalf("first request waited %v, it shouldn't know about the budget yet", *waits)
+			}
+
+			if _, err := get(t, context.Background(), transport, server.URL); err != nil {
+				t.Fatal(err)
+			}
+			if len(*waits) != 1 || (*waits)[0] != tt.want {
+				t.Errorf("second request waited %v, want [%v]", *waits, tt.want)
+			}
+		})
+	}
+}
@@ -1,290 +1,108 @@
 package oneke
 
 import (
-	"bytes"
-	b64 "encoding/base64"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"os"
-	"regexp"
-	"strconv"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/secretsmanager"
 )
 
-// 1ke structs for tests
+// DeleteTest comment
+func (c *Client) DeleteTest(ctx context.Context, testType string, id string) error {
 
-// onekeTestPayload comment
-type onekeTestPayload struct {
-	Test []onekeTest `json:"test"`
-}
+	c.logger.Printf("In delete test for type: %v - ID: %v\n", testType, id)
+	if IsDryRun(ctx) {
+		c.logger.Printf("Dry run - not deleting Test: %v\n", id)
+		return nil
+	}
+	c.logger.Printf("Deleting Test: %v\n", id)
 
-// onekeTest comment
-type onekeTest struct {
-	Enabled  int    `json:"enabled,omitempty"`
-	TestID   int    `json:"testId,omitempty"`
-	TestName string `json:"testName,omitempty"`
-	TestType string `json:"type,omitempty"`
-	URL      string `json:"url,omitempty"`
-}
+	if err := c.api.DeleteTest(ctx, testType, id); err != nil {
+		return fmt.Errorf("deleting test %v: %w", id, err)
+	}
 
-type onekeHTTPTestCreate struct {
-	Interval            int          `json:"interval,omitempty"`
-	Agents              []onekeAgent `json:"agents,omitempty"`
-	TestName            string       `json:"testName,omitempty"`
-	ContentRegex        string       `json:"contentRegex,omitempty"`
-	URL                 string       `json:"url,omitempty"`
-	AlertsEnabled       int          `json:"alertsEnabled"`
-	BgpMeasurements     int          `json:"bgpMeasurements"`
-	NetworkMeasurements int          `json:"networkMeasurements"`
-	VerifyCertificate   int          `json:"verifyCertificate"`
-}
+	c.logger.Printf("Deleted Test: %v\n", id)
+	return nil
 
-type onekeAgent struct {
-	AgentID int `json:"agentId,omitempty"`
 }
 
-func make1keRequest(reqType string, user string, token string, reqEndpoint string, reqPayload []byte) io.ReadCloser {
-
-	fmt.Printf("make1keRequest called...\n")
-	reqBody := bytes.NewBuffer(reqPayload)
+// CreateTest comment - spec is the test as the plan built it from its template, named and labelled
+func (c *Client) CreateTest(ctx context.Context, spec TestSpec) (Test, error) {
 
-	baseurl := "https://api.thousandeyes.com/v6" + reqEndpoint
-	credsString := user + ":" + token
-	sEnc := b64.StdEncoding.EncodeToString([]byte(credsString))
+	c.logger.Printf("CreateTest called - type %v\n", spec.Type)
 
-	req, err := http.NewRequest(reqType, baseurl, reqBody)
-	if err != nil {
-		fmt.Printf("Failed to create new HTTP request")
-		os.Exit(2)
+	if IsDryRun(ctx) {
+		c.logger.Printf("Dry run - not creating Test: %v\n", spec.Name)
+		return Test{ID: dryRunID(spec.Name), Name: spec.Name, Type: spec.Type, URL: spec.URL, Server: spec.Server, Domain: spec.Domain, Enabled: true, Interval: spec.Interval}, nil
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", "Basic "+sEnc)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-
+	c.logger.Printf("Creating Test: %v\n", spec.Name)
+	created, err := c.api.CreateTest(ctx, spec)
 	if err != nil {
-		fmt.Printf("Client error - %v", resp)
-		os.Exit(2)
+		return Test{}, fmt.Errorf("creating test %v: %w", spec.Name, err)
 	}
-
-	//fmt.Printf("resp is %v", resp)
-	return resp.Body
+	c.logger.Printf("Created Test: %v - ID: %v\n", spec.Name, created.ID)
+	return created, nil
 
 }
 
-//DeleteTest comment
-func DeleteTest(testType string, id int) {
-
-	fmt.Printf("In delete test for type: %v - ID: %v\n", testType, id)
+// UpdateTest changes an existing test to match spec, for when the caller has already worked out it's drifted
+func (c *Client) UpdateTest(ctx context.Context, existing Test, spec TestSpec) (Test, error) {
 
-	stringid := strconv.Itoa(id)
-
-	deleteString := "/tests/" + testType + "/" + stringid + "/delete.json"
-	fmt.Printf("Delete string is %v\n", deleteString)
-
-	user, token := Get1keToken()
-	//fmt.Printf("User is %v and token is %v\n", user, token)
-	if token != "" && user != "" {
-		fmt.Printf("1ke API token and user retrieved successfully\n")
-		fmt.Printf("Deleting Test: %v\n", id)
-		resp := make1keRequest("POST", user, token, deleteString, nil)
-		fmt.Printf("Response from delete request: %v\n", resp)
+	if IsDryRun(ctx) {
+		c.logger.Printf("Dry run - not updating Test: %v - ID: %v\n", spec.Name, existing.ID)
+		return existing, nil
 	}
-
-}
-
-// CreateTest comment
-func CreateTest(stack string, testType string, testURL string, testID string) {
-
-	fmt.Printf("CreateTest called...\n")
-	switch testType {
-	case "http-server":
-		fmt.Printf("http-server test detected\n")
-
-		testName := "stack=" + stack + " id=" + testID + " metric=web_check testname=web_check~" + testURL
-		body := onekeHTTPTestCreate{
-			Interval:            60,
-			Agents:              []onekeAgent{{AgentID: 14410}},
-			TestName:            testName,
-			ContentRegex:        "someregex",
-			URL:                 testURL,
-			AlertsEnabled:       0,
-			BgpMeasurements:     0,
-			NetworkMeasurements: 0,
-			VerifyCertificate:   0,
-		}
-
-		var jsonData []byte
-		jsonData, err := json.Marshal(body)
-		if err != nil {
-			log.Println(err)
-		}
-
-		fmt.Println(string(jsonData))
-
-		user, token := Get1keToken()
-		//fmt.Printf("User is %v and token is %v\n", user, token)
-		if token != "" && user != "" {
-			fmt.Printf("1ke API token and user retrieved successfully\n")
-			fmt.Printf("Creating Test: %v\n", testName)
-			make1keRequest("POST", user, token, "/tests/http-server/new.json", jsonData)
-		}
-
-	case "other-test":
-		fmt.Printf("other test\n")
-
+	c.logger.Printf("Updating Test: %v - ID: %v\n", spec.Name, existing.ID)
+	updated, err := c.api.UpdateTest(ctx, existing.Type, existing.ID, spec)
+	if err != nil {
+		return Test{}, fmt.Errorf("updating test %v: %w", existing.ID, err)
 	}
+	c.logger.Printf("Updated Test: %v\n", existing.ID)
+	return updated, nil
 
 }
 
-// GatherTestsForStack comment
-func GatherTestsForStack(stack string) map[string]map[string]interface{} {
+// LoadDetails fetches the full configuration of each of tests and records it in inv, so drift can be worked
+// out without going back to ThousandEyes
+func (c *Client) LoadDetails(ctx context.Context, inv *Inventory, tests []Test) error {
 
-	stackTests := make(map[string]map[string]interface{})
-	allTests := GatherAllTests()
-
-	for url := range allTests {
-		//fmt.Printf("URL - %v - Deets - %v\n", url, deets)
-		regexString := ".+" + stack + "\\.(?:stg|companyworks|companycloud)?\\.(?:companycloud|com|lol)?"
-		//matched, err := regexp.MatchString("(.+)something\\.(?:stg|companyworks|companycloud)?\\.(?:companycloud|com|lol)?", url)
-		matched, err := regexp.MatchString(regexString, url)
-		if matched {
-			inner, ok := stackTests[url]
-			if !ok {
-				inner = make(map[string]interface{})
-				stackTests[url] = inner
-			}
-
-			stackTests[url]["testName"] = allTests[url]["testName"]
-			stackTests[url]["testType"] = allTests[url]["testType"]
-			stackTests[url]["testID"] = allTests[url]["testID"]
-		}
+	for _, test := range tests {
+		details, err := c.api.GetTest(ctx, test.Type, test.ID)
 		if err != nil {
-			fmt.Printf("Regex Issue, %v", err)
+			return fmt.Errorf("fetching test %v: %w", test.ID, err)
 		}
+		inv.SetDetails(test.ID, details)
 	}
-
-	return stackTests
+	return nil
 
 }
 
-// GatherAllTests comment
-func GatherAllTests() map[string]map[string]interface{} {
-
-	fmt.Printf("GatherAllTests called...\n")
-	// let's get user and token to make API call
-
-	user, token := Get1keToken()
-	if token != "" && user != "" {
-		fmt.Printf("1ke API token and user retrieved successfully\n")
-	}
-
-	requestBody := make1keRequest("GET", user, token, "/tests", nil)
-
-	clientByteValue, _ := ioutil.ReadAll(requestBody)
-	var clientResults onekeTestPayload
-	if err := json.Unmarshal(clientByteValue, &clientResults); err != nil {
-		panic(err)
-	}
-
-	onekeTestData := make(map[string]map[string]interface{})
+// GatherTestsForStack returns the tests belonging to stack according to the client's ownership rules, each
+// with an explanation of why it matched
+func (c *Client) GatherTestsForStack(ctx context.Context, stack string) (*Inventory, error) {
 
-	for _, test := range clientResults.Test {
-		inner, ok := onekeTestData[test.URL]
-		if !ok {
-			inner = make(map[string]interface{})
-			onekeTestData[test.URL] = inner
-		}
-		onekeTestData[test.URL]["testName"] = test.TestName
-		onekeTestData[test.URL]["testType"] = test.TestType
-		onekeTestData[test.URL]["testID"] = test.TestID
+	allTests, err := c.GatherAllTests(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	/*
-		testMap looks like:
-		onekeTestData["https://something.companycloud.com/en-US/account/login?loginType=company"]["testName"] = "stack=something id=standard metric=web_check testname=web_check~https://something.companycloud.com/en-US/account/login?loginType=company"
-		onekeTestData["https://something.companycloud.com/en-US/account/login?loginType=company"]["testID"] = "123567"
-		onekeTestData["https://something.companycloud.com/en-US/account/login?loginType=company"]["testType"] = "http-server"
-	*/
+	return allTests.ForStack(stack, c.ownership), nil
 
-	return onekeTestData
 }
 
-// Get1keToken comment
-func Get1keToken() (string, string) {
-
-	fmt.Println("Get1keToken called...")
-	secretName := "some-api"
-	region := "us-west-2"
-	fmt.Println("us-west-2 region set for secret management...")
+// GatherAllTests returns every test in the account as an Inventory
+func (c *Client) GatherAllTests(ctx context.Context) (*Inventory, error) {
 
-	//Create a Secrets Manager client
-	svc := secretsmanager.New(session.New(), aws.NewConfig().WithRegion(region))
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId:     aws.String(secretName),
-		VersionStage: aws.String("AWSCURRENT"), // VersionStage defaults to AWSCURRENT if unspecified
-	}
-
-	result, err := svc.GetSecretValue(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case secretsmanager.ErrCodeDecryptionFailure:
-				// Secrets Manager can't decrypt the protected secret text using the provided KMS key.
-				fmt.Println(secretsmanager.ErrCodeDecryptionFailure, aerr.Error())
-
-			case secretsmanager.ErrCodeInternalServiceError:
-				// An error occurred on the server side.
-				fmt.Println(secretsmanager.ErrCodeInternalServiceError, aerr.Error())
-
-			case secretsmanager.ErrCodeInvalidParameterException:
-				// You provided an invalid value for a parameter.
-				fmt.Println(secretsmanager.ErrCodeInvalidParameterException, aerr.Error())
-
-			case secretsmanager.ErrCodeInvalidRequestException:
-				// You provided a parameter value that is not valid for the current state of the resource.
-				fmt.Println(secretsmanager.ErrCodeInvalidRequestException, aerr.Error())
-
-			case secretsmanager.ErrCodeResourceNotFoundException:
-				// We can't find the resource that you asked for.
-				fmt.Println(secretsmanager.ErrCodeResourceNotFoundException, aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-
-	}
+	c.logger.Printf("GatherAllTests called...\n")
 
-	// Decrypts secret using the associated KMS CMK.
+	inv := NewInventory()
 
-	var secretString string
-	if result.SecretString != nil {
-		secretString = *result.SecretString
+	it := c.ListTests(ctx)
+	for it.Next() {
+		inv.Add(it.Test())
 	}
-
-	var secretJSON map[string]string
-	json.Unmarshal([]byte(secretString), &secretJSON)
-
-	var onekeUser string
-	var onekeToken string
-
-	for fonekeUser, fonekeToken := range secretJSON {
-		onekeUser = fonekeUser
-		onekeToken = fonekeToken
+	if err := it.Err(); err != nil {
+		return nil, err
 	}
 
-	return onekeUser, onekeToken
-
+	return inv, nil
 }
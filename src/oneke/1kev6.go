@@ -0,0 +1,588 @@
+package oneke
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// v6 wire format
+
+// onekeTestPayload comment
+type onekeTestPayload struct {
+	Test  []onekeTest `json:"test"`
+	Pages onekePages  `json:"pages,omitempty"`
+}
+
+// onekeTest comment
+type onekeTest struct {
+	Enabled  int    `json:"enabled,omitempty"`
+	TestID   int    `json:"testId,omitempty"`
+	TestName string `json:"testName,omitempty"`
+	TestType string `json:"type,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Server   string `json:"server,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Interval int    `json:"interval,omitempty"`
+
+	Groups []onekeTestGroup `json:"groups,omitempty"`
+}
+
+// onekeTestGroup is a v6 group, which is what v7 calls a label
+type onekeTestGroup struct {
+	GroupID int    `json:"groupId,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+func (t onekeTest) toTest() Test {
+	test := Test{
+		ID:       strconv.Itoa(t.TestID),
+		Name:     t.TestName,
+		Type:     t.TestType,
+		URL:      t.URL,
+		Server:   t.Server,
+		Domain:   t.Domain,
+		Enabled:  t.Enabled == 1,
+		Interval: t.Interval,
+	}
+	for _, group := range t.Groups {
+		test.Labels = append(test.Labels, group.Name)
+	}
+	return test
+}
+
+// onekeTestDetails is a single v6 test with everything we might want to compare. v6 sends the same shape
+// for every type, with the fields that don't apply left out.
+type onekeTestDetails struct {
+	TestName            string           `json:"testName"`
+	Type                string           `json:"type"`
+	Interval            int              `json:"interval"`
+	Agents              []onekeAgent     `json:"agents"`
+	AlertsEnabled       int              `json:"alertsEnabled"`
+	AlertRules          []onekeAlertRule `json:"alertRules"`
+	BgpMeasurements     int              `json:"bgpMeasurements"`
+	NetworkMeasurements int              `json:"networkMeasurements"`
+	URL                 string           `json:"url"`
+	ContentRegex        string           `json:"contentRegex"`
+	HTTPTimeLimit       int              `json:"httpTimeLimit"`
+	Headers             []string         `json:"headers"`
+	DesiredStatusCode   string           `json:"desiredStatusCode"`
+	VerifyCertificate   int              `json:"verifyCertificate"`
+	HTTPInterval        int              `json:"httpInterval"`
+	Server              string           `json:"server"`
+	Port                int              `json:"port"`
+	Protocol            string           `json:"protocol"`
+	Domain              string           `json:"domain"`
+	DNSServers          []onekeDNSServer `json:"dnsServers"`
+	Groups              []onekeTestGroup `json:"groups"`
+}
+
+type onekeTestDetailsPayload struct {
+	Test []onekeTestDetails `json:"test"`
+}
+
+func (t onekeTestDetails) toSpec() TestSpec {
+
+	spec := TestSpec{
+		Name:                t.TestName,
+		Type:                t.Type,
+		Interval:            t.Interval,
+		AlertsEnabled:       t.AlertsEnabled == 1,
+		BGPMeasurements:     t.BgpMeasurements == 1,
+		NetworkMeasurements: t.NetworkMeasurements == 1,
+		URL:                 t.URL,
+		ContentRegex:        t.ContentRegex,
+		TimeoutMs:           t.HTTPTimeLimit,
+		Headers:             t.Headers,
+		VerifyCertificate:   t.VerifyCertificate == 1,
+		PageLoadInterval:    t.HTTPInterval,
+		Server:              t.Server,
+		Port:                t.Port,
+		Protocol:            t.Protocol,
+		Domain:              t.Domain,
+	}
+	spec.ExpectedStatusCode, _ = strconv.Atoi(t.DesiredStatusCode)
+
+	for _, agent := range t.Agents {
+		spec.AgentIDs = append(spec.AgentIDs, strconv.Itoa(agent.AgentID))
+	}
+	for _, rule := range t.AlertRules {
+		spec.AlertRuleIDs = append(spec.AlertRuleIDs, strconv.Itoa(rule.RuleID))
+	}
+	for _, server := range t.DNSServers {
+		spec.DNSServers = append(spec.DNSServers, server.ServerName)
+	}
+	for _, group := range t.Groups {
+		spec.LabelIDs = append(spec.LabelIDs, strconv.Itoa(group.GroupID))
+	}
+
+	return spec
+}
+
+// onekeTestCommon is the part of every v6 create payload that doesn't depend on the test type
+type onekeTestCommon struct {
+	TestName      string           `json:"testName,omitempty"`
+	Interval      int              `json:"interval,omitempty"`
+	Agents        []onekeAgent     `json:"agents,omitempty"`
+	AlertsEnabled int              `json:"alertsEnabled"`
+	AlertRules    []onekeAlertRule `json:"alertRules,omitempty"`
+	Groups        []onekeTestGroup `json:"groups,omitempty"`
+}
+
+type onekeHTTPTestCreate struct {
+	onekeTestCommon
+	ContentRegex        string   `json:"contentRegex,omitempty"`
+	URL                 string   `json:"url,omitempty"`
+	HTTPTimeLimit       int      `json:"httpTimeLimit,omitempty"`
+	Headers             []string `json:"headers,omitempty"`
+	DesiredStatusCode   string   `json:"desiredStatusCode,omitempty"`
+	BgpMeasurements     int      `json:"bgpMeasurements"`
+	NetworkMeasurements int      `json:"networkMeasurements"`
+	VerifyCertificate   int      `json:"verifyCertificate"`
+}
+
+type onekePageLoadTestCreate struct {
+	onekeTestCommon
+	URL                 string   `json:"url"`
+	HTTPInterval        int      `json:"httpInterval,omitempty"`
+	HTTPTimeLimit       int      `json:"httpTimeLimit,omitempty"`
+	Headers             []string `json:"headers,omitempty"`
+	BgpMeasurements     int      `json:"bgpMeasurements"`
+	NetworkMeasurements int      `json:"networkMeasurements"`
+	VerifyCertificate   int      `json:"verifyCertificate"`
+}
+
+type onekeAgentToServerTestCreate struct {
+	onekeTestCommon
+	Server          string `json:"server"`
+	Port            int    `json:"port,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	BgpMeasurements int    `json:"bgpMeasurements"`
+}
+
+type onekeDNSServerTestCreate struct {
+	onekeTestCommon
+	Domain          string           `json:"domain"`
+	DNSServers      []onekeDNSServer `json:"dnsServers"`
+	BgpMeasurements int              `json:"bgpMeasurements"`
+}
+
+type onekeDNSTraceTestCreate struct {
+	onekeTestCommon
+	Domain string `json:"domain"`
+}
+
+type onekeDNSServer struct {
+	ServerName string `json:"serverName"`
+}
+
+type onekeAgent struct {
+	AgentID int `json:"agentId,omitempty"`
+}
+
+type onekeAlertRule struct {
+	RuleID int `json:"ruleId,omitempty"`
+}
+
+type onekeAgentList struct {
+	Agents []onekeAgentDetails `json:"agents"`
+}
+
+type onekeAgentDetails struct {
+	AgentID   int               `json:"agentId"`
+	AgentName string            `json:"agentName"`
+	AgentType string            `json:"agentType"`
+	Location  string            `json:"location"`
+	CountryID string            `json:"countryId"`
+	Enabled   *int              `json:"enabled,omitempty"`
+	Groups    []onekeAgentGroup `json:"groups,omitempty"`
+}
+
+type onekeAgentGroup struct {
+	Name string `json:"name"`
+}
+
+func (a onekeAgentDetails) toAgent() Agent {
+	agent := Agent{
+		ID:        strconv.Itoa(a.AgentID),
+		Name:      a.AgentName,
+		Type:      normaliseAgentType(a.AgentType),
+		Location:  a.Location,
+		CountryID: a.CountryID,
+		// cloud agents don't say, they're always on
+		Enabled: a.Enabled == nil || *a.Enabled == 1,
+	}
+	for _, group := range a.Groups {
+		agent.Labels = append(agent.Labels, group.Name)
+	}
+	return agent
+}
+
+// v6API speaks the original /v6 API - .json endpoints, everything done with GET and POST
+type v6API struct {
+	client *Client
+}
+
+func (a *v6API) ListTests(ctx context.Context) *TestIterator {
+
+	return newTestIterator(ctx, a.client, "/tests", func(ctx context.Context, endpoint string) ([]Test, string, error) {
+
+		var results onekeTestPayload
+		if err := a.client.make1keJSONRequest(ctx, "GET", endpoint, nil, &results); err != nil {
+			return nil, "", err
+		}
+
+		tests := make([]Test, 0, len(results.Test))
+		for _, test := range results.Test {
+			tests = append(tests, test.toTest())
+		}
+
+		return tests, results.Pages.Next, nil
+	})
+}
+
+func (a *v6API) CreateTest(ctx context.Context, spec TestSpec) (Test, error) {
+
+	endpoint := "/tests/" + spec.Type + "/new.json"
+
+	body, err := v6CreatePayload(spec)
+	if err != nil {
+		return Test{}, err
+	}
+
+	var created onekeTestPayload
+	if err := a.client.make1keJSONRequest(ctx, "POST", endpoint, body, &created); err != nil {
+		return Test{}, err
+	}
+	if len(created.Test) == 0 {
+		return Test{}, &DecodeError{Endpoint: endpoint, Err: fmt.Errorf("no test in response")}
+	}
+
+	return created.Test[0].toTest(), nil
+}
+
+// v6CreatePayload builds the typed create body for the spec's test type
+func v6CreatePayload(spec TestSpec) (interface{}, error) {
+
+	common := onekeTestCommon{
+		TestName:      spec.Name,
+		Interval:      spec.Interval,
+		AlertsEnabled: boolToInt(spec.AlertsEnabled),
+	}
+
+	for _, id := range spec.AgentIDs {
+		agentID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("oneke: v6 agent IDs are numeric, got %q", id)
+		}
+		common.Agents = append(common.Agents, onekeAgent{AgentID: agentID})
+	}
+
+	for _, id := range spec.AlertRuleIDs {
+		ruleID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("oneke: v6 alert rule IDs are numeric, got %q", id)
+		}
+		common.AlertRules = append(common.AlertRules, onekeAlertRule{RuleID: ruleID})
+	}
+
+	for _, id := range spec.LabelIDs {
+		groupID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("oneke: v6 group IDs are numeric, got %q", id)
+		}
+		common.Groups = append(common.Groups, onekeTestGroup{GroupID: groupID})
+	}
+
+	switch spec.Type {
+	case TestTypeHTTPServer:
+		return onekeHTTPTestCreate{
+			onekeTestCommon:     common,
+			ContentRegex:        spec.ContentRegex,
+			URL:                 spec.URL,
+			HTTPTimeLimit:       spec.TimeoutMs,
+			Headers:             spec.Headers,
+			DesiredStatusCode:   statusCodeString(spec.ExpectedStatusCode),
+			BgpMeasurements:     boolToInt(spec.BGPMeasurements),
+			NetworkMeasurements: boolToInt(spec.NetworkMeasurements),
+			VerifyCertificate:   boolToInt(spec.VerifyCertificate),
+		}, nil
+
+	case TestTypePageLoad:
+		return onekePageLoadTestCreate{
+			onekeTestCommon:     common,
+			URL:                 spec.URL,
+			HTTPInterval:        spec.PageLoadInterval,
+			HTTPTimeLimit:       spec.TimeoutMs,
+			Headers:             spec.Headers,
+			BgpMeasurements:     boolToInt(spec.BGPMeasurements),
+			NetworkMeasurements: boolToInt(spec.NetworkMeasurements),
+			VerifyCertificate:   boolToInt(spec.VerifyCertificate),
+		}, nil
+
+	case TestTypeAgentToServer:
+		return onekeAgentToServerTestCreate{
+			onekeTestCommon: common,
+			Server:          spec.Server,
+			Port:            spec.Port,
+			Protocol:        spec.Protocol,
+			BgpMeasurements: boolToInt(spec.BGPMeasurements),
+		}, nil
+
+	case TestTypeDNSServer:
+		servers := make([]onekeDNSServer, 0, len(spec.DNSServers))
+		for _, server := range spec.DNSServers {
+			servers = append(servers, onekeDNSServer{ServerName: server})
+		}
+		return onekeDNSServerTestCreate{
+			onekeTestCommon: common,
+			Domain:          spec.Domain,
+			DNSServers:      servers,
+			BgpMeasurements: boolToInt(spec.BGPMeasurements),
+		}, nil
+
+	case TestTypeDNSTrace:
+		return onekeDNSTraceTestCreate{
+			onekeTestCommon: common,
+			Domain:          spec.Domain,
+		}, nil
+
+	case TestTypeAPI:
+		return nil, fmt.Errorf("oneke: api tests need the v7 API")
+	}
+
+	return nil, fmt.Errorf("oneke: unsupported test type %q", spec.Type)
+}
+
+func (a *v6API) GetTest(ctx context.Context, testType string, id string) (TestSpec, error) {
+
+	endpoint := "/tests/" + id + ".json"
+
+	var results onekeTestDetailsPayload
+	if err := a.client.make1keJSONRequest(ctx, "GET", endpoint, nil, &results); err != nil {
+		return TestSpec{}, err
+	}
+	if len(results.Test) == 0 {
+		return TestSpec{}, &DecodeError{Endpoint: endpoint, Err: fmt.Errorf("no test in response")}
+	}
+
+	return results.Test[0].toSpec(), nil
+}
+
+func (a *v6API) UpdateTest(ctx context.Context, testType string, id string, spec TestSpec) (Test, error) {
+
+	// v6 takes the same body for an update as a create, anything left out stays as it is
+	endpoint := "/tests/" + testType + "/" + id + "/update.json"
+
+	body, err := v6CreatePayload(spec)
+	if err != nil {
+		return Test{}, err
+	}
+
+	// applying the same update twice does no harm so let the transport retry it
+	var updated onekeTestPayload
+	if err := a.client.make1keJSONRequest(withIdempotent(ctx), "POST", endpoint, body, &updated); err != nil {
+		return Test{}, err
+	}
+	if len(updated.Test) == 0 {
+		return Test{}, &DecodeError{Endpoint: endpoint, Err: fmt.Errorf("no test in response")}
+	}
+
+	return updated.Test[0].toTest(), nil
+}
+
+func (a *v6API) DeleteTest(ctx context.Context, testType string, id string) error {
+
+	deleteString := "/tests/" + testType + "/" + id + "/delete.json"
+	a.client.logger.Printf("Delete string is %v\n", deleteString)
+
+	// deleting the same test twice does no harm so let the transport retry it
+	_, err := a.client.make1keRequest(withIdempotent(ctx), "POST", deleteString, nil)
+	return err
+}
+
+func (a *v6API) ListAgents(ctx context.Context) ([]Agent, error) {
+
+	var results onekeAgentList
+	if err := a.client.make1keJSONRequest(ctx, "GET", "/agents", nil, &results); err != nil {
+		return nil, err
+	}
+
+	agents := make([]Agent, 0, len(results.Agents))
+	for _, agent := range results.Agents {
+		agents = append(agents, agent.toAgent())
+	}
+	return agents, nil
+}
+
+type onekeGroupList struct {
+	Groups []onekeGroupDetails `json:"groups"`
+}
+
+type onekeGroupDetails struct {
+	GroupID int         `json:"groupId"`
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Tests   []onekeTest `json:"tests,omitempty"`
+}
+
+func (a *v6API) ListLabels(ctx context.Context) ([]Label, error) {
+
+	var results onekeGroupList
+	if err := a.client.make1keJSONRequest(ctx, "GET", "/groups/tests", nil, &results); err != nil {
+		return nil, err
+	}
+
+	labels := make([]Label, 0, len(results.Groups))
+	for _, group := range results.Groups {
+		labels = append(labels, Label{ID: strconv.Itoa(group.GroupID), Name: group.Name})
+	}
+	return labels, nil
+}
+
+func (a *v6API) CreateLabel(ctx context.Context, name string) (Label, error) {
+
+	endpoint := "/groups/tests/new.json"
+
+	var created onekeGroupList
+	if err := a.client.make1keJSONRequest(ctx, "POST", endpoint, onekeTestGroup{Name: name}, &created); err != nil {
+		return Label{}, err
+	}
+	if len(created.Groups) == 0 {
+		return Label{}, &DecodeError{Endpoint: endpoint, Err: fmt.Errorf("no group in response")}
+	}
+
+	return Label{ID: strconv.Itoa(created.Groups[0].GroupID), Name: created.Groups[0].Name}, nil
+}
+
+func (a *v6API) LabelTests(ctx context.Context, labelID string) ([]Test, error) {
+
+	endpoint := "/groups/" + labelID + ".json"
+
+	var results onekeGroupList
+	if err := a.client.make1keJSONRequest(ctx, "GET", endpoint, nil, &results); err != nil {
+		return nil, err
+	}
+	if len(results.Groups) == 0 {
+		return nil, &DecodeError{Endpoint: endpoint, Err: fmt.Errorf("no group in response")}
+	}
+
+	tests := make([]Test, 0, len(results.Groups[0].Tests))
+	for _, test := range results.Groups[0].Tests {
+		tests = append(tests, test.toTest())
+	}
+	return tests, nil
+}
+
+type onekeAlertRuleList struct {
+	AlertRules []onekeAlertRuleDetails `json:"alertRules"`
+}
+
+type onekeAlertRuleDetails struct {
+	RuleID                  int                      `json:"ruleId,omitempty"`
+	RuleName                string                   `json:"ruleName"`
+	AlertType               string                   `json:"alertType"`
+	Expression              string                   `json:"expression"`
+	MinimumSources          int                      `json:"minimumSources,omitempty"`
+	MinimumSourcesPct       int                      `json:"minimumSourcesPct,omitempty"`
+	RoundsViolatingRequired int                      `json:"roundsViolatingRequired,omitempty"`
+	RoundsViolatingOutOf    int                      `json:"roundsViolatingOutOf,omitempty"`
+	Severity                string                   `json:"severity,omitempty"`
+	Notifications           *onekeAlertNotifications `json:"notifications,omitempty"`
+}
+
+type onekeAlertNotifications struct {
+	Email      *onekeAlertEmail        `json:"email,omitempty"`
+	ThirdParty []onekeAlertIntegration `json:"thirdParty,omitempty"`
+}
+
+type onekeAlertEmail struct {
+	Recipient []string `json:"recipient,omitempty"`
+}
+
+type onekeAlertIntegration struct {
+	IntegrationID   string `json:"integrationId"`
+	IntegrationType string `json:"integrationType"`
+}
+
+func (r onekeAlertRuleDetails) toAlertRule() AlertRule {
+	rule := AlertRule{
+		ID:                      strconv.Itoa(r.RuleID),
+		Name:                    r.RuleName,
+		TestType:                testTypeForAlertType(alertTypesV6, r.AlertType),
+		Expression:              r.Expression,
+		MinimumSources:          r.MinimumSources,
+		MinimumSourcesPct:       r.MinimumSourcesPct,
+		RoundsViolatingRequired: r.RoundsViolatingRequired,
+		RoundsViolatingOutOf:    r.RoundsViolatingOutOf,
+		Severity:                r.Severity,
+	}
+	if r.Notifications != nil {
+		if r.Notifications.Email != nil {
+			rule.Emails = r.Notifications.Email.Recipient
+		}
+		for _, integration := range r.Notifications.ThirdParty {
+			rule.Integrations = append(rule.Integrations, AlertIntegration{ID: integration.IntegrationID, Type: integration.IntegrationType})
+		}
+	}
+	return rule
+}
+
+func v6AlertRulePayload(rule AlertRule) onekeAlertRuleDetails {
+	payload := onekeAlertRuleDetails{
+		RuleName:                rule.Name,
+		AlertType:               alertTypesV6[rule.TestType],
+		Expression:              rule.Expression,
+		MinimumSources:          rule.MinimumSources,
+		MinimumSourcesPct:       rule.MinimumSourcesPct,
+		RoundsViolatingRequired: rule.RoundsViolatingRequired,
+		RoundsViolatingOutOf:    rule.RoundsViolatingOutOf,
+		Severity:                rule.Severity,
+		Notifications:           &onekeAlertNotifications{},
+	}
+	if len(rule.Emails) > 0 {
+		payload.Notifications.Email = &onekeAlertEmail{Recipient: rule.Emails}
+	}
+	for _, integration := range rule.Integrations {
+		payload.Notifications.ThirdParty = append(payload.Notifications.ThirdParty, onekeAlertIntegration{IntegrationID: integration.ID, IntegrationType: integration.Type})
+	}
+	return payload
+}
+
+func (a *v6API) ListAlertRules(ctx context.Context) ([]AlertRule, error) {
+
+	var results onekeAlertRuleList
+	if err := a.client.make1keJSONRequest(ctx, "GET", "/alert-rules", nil, &results); err != nil {
+		return nil, err
+	}
+
+	rules := make([]AlertRule, 0, len(results.AlertRules))
+	for _, rule := range results.AlertRules {
+		rules = append(rules, rule.toAlertRule())
+	}
+	return rules, nil
+}
+
+func (a *v6API) CreateAlertRule(ctx context.Context, rule AlertRule) (AlertRule, error) {
+	return a.sendAlertRule(ctx, "/alert-rules/new.json", rule)
+}
+
+func (a *v6API) UpdateAlertRule(ctx context.Context, id string, rule AlertRule) (AlertRule, error) {
+	// like test updates it's safe to send twice
+	return a.sendAlertRule(withIdempotent(ctx), "/alert-rules/"+id+"/update.json", rule)
+}
+
+// sendAlertRule is the part creating and updating have in common, v6 takes the same body for both
+func (a *v6API) sendAlertRule(ctx context.Context, endpoint string, rule AlertRule) (AlertRule, error) {
+
+	var results onekeAlertRuleList
+	if err := a.client.make1keJSONRequest(ctx, "POST", endpoint, v6AlertRulePayload(rule), &results); err != nil {
+		return AlertRule{}, err
+	}
+	if len(results.AlertRules) == 0 {
+		return AlertRule{}, &DecodeError{Endpoint: endpoint, Err: fmt.Errorf("no alert rule in response")}
+	}
+
+	return results.AlertRules[0].toAlertRule(), nil
+}
@@ -0,0 +1,634 @@
+package oneke
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// v7 wire format - IDs are strings, flags are real booleans and pagination lives under _links
+
+type onekeV7Link struct {
+	Href string `json:"href,omitempty"`
+}
+
+type onekeV7Links struct {
+	Self *onekeV7Link `json:"self,omitempty"`
+	Next *onekeV7Link `json:"next,omitempty"`
+}
+
+type onekeV7TestList struct {
+	Tests []onekeV7Test `json:"tests"`
+	Links onekeV7Links  `json:"_links,omitempty"`
+}
+
+type onekeV7Test struct {
+	TestID   string `json:"testId,omitempty"`
+	TestName string `json:"testName,omitempty"`
+	Type     string `json:"type,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Server   string `json:"server,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Enabled  bool   `json:"enabled,omitempty"`
+	Interval int    `json:"interval,omitempty"`
+
+	Labels []onekeV7TestLabel `json:"labels,omitempty"`
+}
+
+type onekeV7TestLabel struct {
+	LabelID string `json:"labelId,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+func (t onekeV7Test) toTest() Test {
+	test := Test{
+		ID:       t.TestID,
+		Name:     t.TestName,
+		Type:     t.Type,
+		URL:      t.URL,
+		Server:   t.Server,
+		Domain:   t.Domain,
+		Enabled:  t.Enabled,
+		Interval: t.Interval,
+	}
+	for _, label := range t.Labels {
+		test.Labels = append(test.Labels, label.Name)
+	}
+	return test
+}
+
+// onekeV7TestDetails is a single v7 test with everything we might want to compare
+type onekeV7TestDetails struct {
+	TestName            string              `json:"testName"`
+	Type                string              `json:"type"`
+	Interval            int                 `json:"interval"`
+	Agents              []onekeV7Agent      `json:"agents"`
+	AlertsEnabled       bool                `json:"alertsEnabled"`
+	AlertRules          []onekeV7AlertRule  `json:"alertRules"`
+	BGPMeasurements     bool                `json:"bgpMeasurements"`
+	NetworkMeasurements bool                `json:"networkMeasurements"`
+	URL                 string              `json:"url"`
+	ContentRegex        string              `json:"contentRegex"`
+	HTTPTimeLimit       int                 `json:"httpTimeLimit"`
+	Headers             []string            `json:"headers"`
+	DesiredStatusCode   string              `json:"desiredStatusCode"`
+	VerifyCertificate   bool                `json:"verifyCertificate"`
+	HTTPInterval        int                 `json:"httpInterval"`
+	Server              string              `json:"server"`
+	Port                int                 `json:"port"`
+	Protocol            string              `json:"protocol"`
+	Domain              string              `json:"domain"`
+	DNSServers          []onekeV7DNSServer  `json:"dnsServers"`
+	Labels              []onekeV7TestLabel  `json:"labels"`
+	Requests            []onekeV7APIRequest `json:"requests"`
+	TimeLimit           int                 `json:"timeLimit"`
+}
+
+func (t onekeV7TestDetails) toSpec() TestSpec {
+
+	spec := TestSpec{
+		Name:                t.TestName,
+		Type:                t.Type,
+		Interval:            t.Interval,
+		AlertsEnabled:       t.AlertsEnabled,
+		BGPMeasurements:     t.BGPMeasurements,
+		NetworkMeasurements: t.NetworkMeasurements,
+		URL:                 t.URL,
+		ContentRegex:        t.ContentRegex,
+		TimeoutMs:           t.HTTPTimeLimit,
+		Headers:             t.Headers,
+		VerifyCertificate:   t.VerifyCertificate,
+		PageLoadInterval:    t.HTTPInterval,
+		Server:              t.Server,
+		Port:                t.Port,
+		Protocol:            t.Protocol,
+		Domain:              t.Domain,
+	}
+	spec.ExpectedStatusCode, _ = strconv.Atoi(t.DesiredStatusCode)
+
+	for _, agent := range t.Agents {
+		spec.AgentIDs = append(spec.AgentIDs, agent.AgentID)
+	}
+	for _, rule := range t.AlertRules {
+		spec.AlertRuleIDs = append(spec.AlertRuleIDs, rule.RuleID)
+	}
+	for _, server := range t.DNSServers {
+		spec.DNSServers = append(spec.DNSServers, server.ServerName)
+	}
+	for _, label := range t.Labels {
+		spec.LabelIDs = append(spec.LabelIDs, label.LabelID)
+	}
+
+	// api tests keep the request details in their one step, the reverse of v7CreatePayload
+	if t.Type == TestTypeAPI {
+		spec.TimeoutMs = t.TimeLimit * 1000
+		if len(t.Requests) > 0 {
+			request := t.Requests[0]
+			spec.Method = strings.ToUpper(request.Method)
+			spec.RequestBody = request.Body
+			spec.VerifyCertificate = request.VerifyCertificate
+			spec.Headers = nil
+			for _, header := range request.Headers {
+				spec.Headers = append(spec.Headers, header.Key+": "+header.Value)
+			}
+			for _, assertion := range request.Assertions {
+				if assertion.Name == "status-code" {
+					spec.ExpectedStatusCode, _ = strconv.Atoi(assertion.Value)
+				}
+			}
+		}
+	}
+
+	return spec
+}
+
+type onekeV7Agent struct {
+	AgentID string `json:"agentId"`
+}
+
+type onekeV7AlertRule struct {
+	RuleID string `json:"ruleId"`
+}
+
+// onekeV7TestCommon is the part of every v7 create payload that doesn't depend on the test type
+type onekeV7TestCommon struct {
+	TestName      string             `json:"testName"`
+	Interval      int                `json:"interval,omitempty"`
+	Agents        []onekeV7Agent     `json:"agents,omitempty"`
+	AlertsEnabled bool               `json:"alertsEnabled"`
+	AlertRules    []onekeV7AlertRule `json:"alertRules,omitempty"`
+	Labels        []string           `json:"labels,omitempty"`
+}
+
+type onekeV7HTTPTestCreate struct {
+	onekeV7TestCommon
+	URL                 string   `json:"url"`
+	ContentRegex        string   `json:"contentRegex,omitempty"`
+	HTTPTimeLimit       int      `json:"httpTimeLimit,omitempty"`
+	Headers             []string `json:"headers,omitempty"`
+	DesiredStatusCode   string   `json:"desiredStatusCode,omitempty"`
+	BGPMeasurements     bool     `json:"bgpMeasurements"`
+	NetworkMeasurements bool     `json:"networkMeasurements"`
+	VerifyCertificate   bool     `json:"verifyCertificate"`
+}
+
+type onekeV7PageLoadTestCreate struct {
+	onekeV7TestCommon
+	URL                 string   `json:"url"`
+	HTTPInterval        int      `json:"httpInterval,omitempty"`
+	HTTPTimeLimit       int      `json:"httpTimeLimit,omitempty"`
+	Headers             []string `json:"headers,omitempty"`
+	BGPMeasurements     bool     `json:"bgpMeasurements"`
+	NetworkMeasurements bool     `json:"networkMeasurements"`
+	VerifyCertificate   bool     `json:"verifyCertificate"`
+}
+
+type onekeV7AgentToServerTestCreate struct {
+	onekeV7TestCommon
+	Server          string `json:"server"`
+	Port            int    `json:"port,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	BGPMeasurements bool   `json:"bgpMeasurements"`
+}
+
+type onekeV7DNSServerTestCreate struct {
+	onekeV7TestCommon
+	Domain          string             `json:"domain"`
+	DNSServers      []onekeV7DNSServer `json:"dnsServers"`
+	BGPMeasurements bool               `json:"bgpMeasurements"`
+}
+
+type onekeV7DNSTraceTestCreate struct {
+	onekeV7TestCommon
+	Domain string `json:"domain"`
+}
+
+type onekeV7DNSServer struct {
+	ServerName string `json:"serverName"`
+}
+
+type onekeV7APITestCreate struct {
+	onekeV7TestCommon
+	URL                 string              `json:"url"`
+	Requests            []onekeV7APIRequest `json:"requests"`
+	TimeLimit           int                 `json:"timeLimit,omitempty"`
+	NetworkMeasurements bool                `json:"networkMeasurements"`
+}
+
+type onekeV7APIRequest struct {
+	Name              string             `json:"name"`
+	URL               string             `json:"url"`
+	Method            string             `json:"method,omitempty"`
+	Headers           []onekeV7APIHeader `json:"headers,omitempty"`
+	Body              string             `json:"body,omitempty"`
+	VerifyCertificate bool               `json:"verifyCertificate"`
+	Assertions        []onekeV7Assertion `json:"assertions,omitempty"`
+}
+
+type onekeV7APIHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type onekeV7Assertion struct {
+	Name     string `json:"name"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type onekeV7AgentList struct {
+	Agents []onekeV7AgentDetails `json:"agents"`
+}
+
+type onekeV7AgentDetails struct {
+	AgentID   string              `json:"agentId"`
+	AgentName string              `json:"agentName"`
+	AgentType string              `json:"agentType"`
+	Location  string              `json:"location"`
+	CountryID string              `json:"countryId"`
+	Enabled   *bool               `json:"enabled,omitempty"`
+	Labels    []onekeV7AgentLabel `json:"labels,omitempty"`
+}
+
+type onekeV7AgentLabel struct {
+	Name string `json:"name"`
+}
+
+func (a onekeV7AgentDetails) toAgent() Agent {
+	agent := Agent{
+		ID:        a.AgentID,
+		Name:      a.AgentName,
+		Type:      normaliseAgentType(a.AgentType),
+		Location:  a.Location,
+		CountryID: a.CountryID,
+		Enabled:   a.Enabled == nil || *a.Enabled,
+	}
+	for _, label := range a.Labels {
+		agent.Labels = append(agent.Labels, label.Name)
+	}
+	return agent
+}
+
+// v7API speaks the /v7 API - proper REST verbs on /tests/{type}/{id} and bearer tokens
+type v7API struct {
+	client *Client
+}
+
+func (a *v7API) ListTests(ctx context.Context) *TestIterator {
+
+	return newTestIterator(ctx, a.client, "/tests", func(ctx context.Context, endpoint string) ([]Test, string, error) {
+
+		var results onekeV7TestList
+		if err := a.client.make1keJSONRequest(ctx, "GET", endpoint, nil, &results); err != nil {
+			return nil, "", err
+		}
+
+		tests := make([]Test, 0, len(results.Tests))
+		for _, test := range results.Tests {
+			tests = append(tests, test.toTest())
+		}
+
+		next := ""
+		if results.Links.Next != nil {
+			next = results.Links.Next.Href
+		}
+
+		return tests, next, nil
+	})
+}
+
+func (a *v7API) CreateTest(ctx context.Context, spec TestSpec) (Test, error) {
+
+	endpoint := "/tests/" + url.PathEscape(spec.Type)
+
+	body, err := v7CreatePayload(spec)
+	if err != nil {
+		return Test{}, err
+	}
+
+	var created onekeV7Test
+	if err := a.client.make1keJSONRequest(ctx, "POST", endpoint, body, &created); err != nil {
+		return Test{}, err
+	}
+
+	return created.toTest(), nil
+}
+
+// v7CreatePayload builds the typed create body for the spec's test type
+func v7CreatePayload(spec TestSpec) (interface{}, error) {
+
+	common := onekeV7TestCommon{
+		TestName:      spec.Name,
+		Interval:      spec.Interval,
+		AlertsEnabled: spec.AlertsEnabled,
+	}
+	for _, id := range spec.AgentIDs {
+		common.Agents = append(common.Agents, onekeV7Agent{AgentID: id})
+	}
+	for _, id := range spec.AlertRuleIDs {
+		common.AlertRules = append(common.AlertRules, onekeV7AlertRule{RuleID: id})
+	}
+	common.Labels = spec.LabelIDs
+
+	switch spec.Type {
+	case TestTypeHTTPServer:
+		return onekeV7HTTPTestCreate{
+			onekeV7TestCommon:   common,
+			URL:                 spec.URL,
+			ContentRegex:        spec.ContentRegex,
+			HTTPTimeLimit:       spec.TimeoutMs,
+			Headers:             spec.Headers,
+			DesiredStatusCode:   statusCodeString(spec.ExpectedStatusCode),
+			BGPMeasurements:     spec.BGPMeasurements,
+			NetworkMeasurements: spec.NetworkMeasurements,
+			VerifyCertificate:   spec.VerifyCertificate,
+		}, nil
+
+	case TestTypePageLoad:
+		return onekeV7PageLoadTestCreate{
+			onekeV7TestCommon:   common,
+			URL:                 spec.URL,
+			HTTPInterval:        spec.PageLoadInterval,
+			HTTPTimeLimit:       spec.TimeoutMs,
+			Headers:             spec.Headers,
+			BGPMeasurements:     spec.BGPMeasurements,
+			NetworkMeasurements: spec.NetworkMeasurements,
+			VerifyCertificate:   spec.VerifyCertificate,
+		}, nil
+
+	case TestTypeAgentToServer:
+		return onekeV7AgentToServerTestCreate{
+			onekeV7TestCommon: common,
+			Server:            spec.Server,
+			Port:              spec.Port,
+			Protocol:          spec.Protocol,
+			BGPMeasurements:   spec.BGPMeasurements,
+		}, nil
+
+	case TestTypeDNSServer:
+		servers := make([]onekeV7DNSServer, 0, len(spec.DNSServers))
+		for _, server := range spec.DNSServers {
+			servers = append(servers, onekeV7DNSServer{ServerName: server})
+		}
+		return onekeV7DNSServerTestCreate{
+			onekeV7TestCommon: common,
+			Domain:            spec.Domain,
+			DNSServers:        servers,
+			BGPMeasurements:   spec.BGPMeasurements,
+		}, nil
+
+	case TestTypeDNSTrace:
+		return onekeV7DNSTraceTestCreate{
+			onekeV7TestCommon: common,
+			Domain:            spec.Domain,
+		}, nil
+
+	case TestTypeAPI:
+		request := onekeV7APIRequest{
+			Name:              "step1",
+			URL:               spec.URL,
+			Method:            strings.ToLower(spec.Method),
+			Body:              spec.RequestBody,
+			VerifyCertificate: spec.VerifyCertificate,
+		}
+		for _, header := range spec.Headers {
+			s := strings.SplitN(header, ":", 2)
+			if len(s) != 2 {
+				return nil, fmt.Errorf("oneke: header %q should look like \"Name: value\"", header)
+			}
+			request.Headers = append(request.Headers, onekeV7APIHeader{Key: strings.TrimSpace(s[0]), Value: strings.TrimSpace(s[1])})
+		}
+		if spec.ExpectedStatusCode != 0 {
+			request.Assertions = append(request.Assertions, onekeV7Assertion{Name: "status-code", Operator: "is", Value: statusCodeString(spec.ExpectedStatusCode)})
+		}
+		return onekeV7APITestCreate{
+			onekeV7TestCommon:   common,
+			URL:                 spec.URL,
+			Requests:            []onekeV7APIRequest{request},
+			TimeLimit:           spec.TimeoutMs / 1000,
+			NetworkMeasurements: spec.NetworkMeasurements,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("oneke: unsupported test type %q", spec.Type)
+}
+
+func (a *v7API) GetTest(ctx context.Context, testType string, id string) (TestSpec, error) {
+
+	endpoint := "/tests/" + url.PathEscape(testType) + "/" + url.PathEscape(id)
+
+	var details onekeV7TestDetails
+	if err := a.client.make1keJSONRequest(ctx, "GET", endpoint, nil, &details); err != nil {
+		return TestSpec{}, err
+	}
+	if details.Type == "" {
+		details.Type = testType
+	}
+
+	return details.toSpec(), nil
+}
+
+func (a *v7API) UpdateTest(ctx context.Context, testType string, id string, spec TestSpec) (Test, error) {
+
+	endpoint := "/tests/" + url.PathEscape(testType) + "/" + url.PathEscape(id)
+
+	body, err := v7CreatePayload(spec)
+	if err != nil {
+		return Test{}, err
+	}
+
+	// PUT replaces the whole test, which is what we want as the body is the full spec - and sending it twice
+	// is harmless so the transport can retry it
+	var updated onekeV7Test
+	if err := a.client.make1keJSONRequest(ctx, "PUT", endpoint, body, &updated); err != nil {
+		return Test{}, err
+	}
+
+	return updated.toTest(), nil
+}
+
+func (a *v7API) DeleteTest(ctx context.Context, testType string, id string) error {
+
+	endpoint := "/tests/" + url.PathEscape(testType) + "/" + url.PathEscape(id)
+
+	_, err := a.client.make1keRequest(ctx, "DELETE", endpoint, nil)
+	return err
+}
+
+func (a *v7API) ListAgents(ctx context.Context) ([]Agent, error) {
+
+	var results onekeV7AgentList
+	if err := a.client.make1keJSONRequest(ctx, "GET", "/agents", nil, &results); err != nil {
+		return nil, err
+	}
+
+	agents := make([]Agent, 0, len(results.Agents))
+	for _, agent := range results.Agents {
+		agents = append(agents, agent.toAgent())
+	}
+	return agents, nil
+}
+
+type onekeV7LabelList struct {
+	Labels []onekeV7Label `json:"labels"`
+}
+
+type onekeV7Label struct {
+	LabelID string        `json:"labelId,omitempty"`
+	Name    string        `json:"name"`
+	Type    string        `json:"type,omitempty"`
+	Tests   []onekeV7Test `json:"tests,omitempty"`
+}
+
+func (a *v7API) ListLabels(ctx context.Context) ([]Label, error) {
+
+	var results onekeV7LabelList
+	if err := a.client.make1keJSONRequest(ctx, "GET", "/labels", nil, &results); err != nil {
+		return nil, err
+	}
+
+	labels := make([]Label, 0, len(results.Labels))
+	for _, label := range results.Labels {
+		// v7 puts every kind of label in one list, we only care about test labels
+		if label.Type != "" && label.Type != "tests" {
+			continue
+		}
+		labels = append(labels, Label{ID: label.LabelID, Name: label.Name})
+	}
+	return labels, nil
+}
+
+func (a *v7API) CreateLabel(ctx context.Context, name string) (Label, error) {
+
+	var created onekeV7Label
+	if err := a.client.make1keJSONRequest(ctx, "POST", "/labels", onekeV7Label{Name: name, Type: "tests"}, &created); err != nil {
+		return Label{}, err
+	}
+
+	return Label{ID: created.LabelID, Name: created.Name}, nil
+}
+
+func (a *v7API) LabelTests(ctx context.Context, labelID string) ([]Test, error) {
+
+	var label onekeV7Label
+	if err := a.client.make1keJSONRequest(ctx, "GET", "/labels/"+url.PathEscape(labelID), nil, &label); err != nil {
+		return nil, err
+	}
+
+	tests := make([]Test, 0, len(label.Tests))
+	for _, test := range label.Tests {
+		tests = append(tests, test.toTest())
+	}
+	return tests, nil
+}
+
+type onekeV7AlertRuleList struct {
+	AlertRules []onekeV7AlertRuleDetails `json:"alertRules"`
+}
+
+type onekeV7AlertRuleDetails struct {
+	RuleID                  string                     `json:"ruleId,omitempty"`
+	RuleName                string                     `json:"ruleName"`
+	AlertType               string                     `json:"alertType"`
+	Expression              string                     `json:"expression"`
+	MinimumSources          int                        `json:"minimumSources,omitempty"`
+	MinimumSourcesPct       int                        `json:"minimumSourcesPct,omitempty"`
+	RoundsViolatingRequired int                        `json:"roundsViolatingRequired,omitempty"`
+	RoundsViolatingOutOf    int                        `json:"roundsViolatingOutOf,omitempty"`
+	Severity                string                     `json:"severity,omitempty"`
+	Notifications           *onekeV7AlertNotifications `json:"notifications,omitempty"`
+}
+
+type onekeV7AlertNotifications struct {
+	Email      *onekeV7AlertEmail        `json:"email,omitempty"`
+	ThirdParty []onekeV7AlertIntegration `json:"thirdParty,omitempty"`
+}
+
+type onekeV7AlertEmail struct {
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+type onekeV7AlertIntegration struct {
+	IntegrationID   string `json:"integrationId"`
+	IntegrationType string `json:"integrationType"`
+}
+
+func (r onekeV7AlertRuleDetails) toAlertRule() AlertRule {
+	rule := AlertRule{
+		ID:                      r.RuleID,
+		Name:                    r.RuleName,
+		TestType:                testTypeForAlertType(alertTypesV7, r.AlertType),
+		Expression:              r.Expression,
+		MinimumSources:          r.MinimumSources,
+		MinimumSourcesPct:       r.MinimumSourcesPct,
+		RoundsViolatingRequired: r.RoundsViolatingRequired,
+		RoundsViolatingOutOf:    r.RoundsViolatingOutOf,
+		Severity:                r.Severity,
+	}
+	if r.Notifications != nil {
+		if r.Notifications.Email != nil {
+			rule.Emails = r.Notifications.Email.Recipients
+		}
+		for _, integration := range r.Notifications.ThirdParty {
+			rule.Integrations = append(rule.Integrations, AlertIntegration{ID: integration.IntegrationID, Type: integration.IntegrationType})
+		}
+	}
+	return rule
+}
+
+func v7AlertRulePayload(rule AlertRule) onekeV7AlertRuleDetails {
+	payload := onekeV7AlertRuleDetails{
+		RuleName:                rule.Name,
+		AlertType:               alertTypesV7[rule.TestType],
+		Expression:              rule.Expression,
+		MinimumSources:          rule.MinimumSources,
+		MinimumSourcesPct:       rule.MinimumSourcesPct,
+		RoundsViolatingRequired: rule.RoundsViolatingRequired,
+		RoundsViolatingOutOf:    rule.RoundsViolatingOutOf,
+		Severity:                rule.Severity,
+		Notifications:           &onekeV7AlertNotifications{},
+	}
+	if len(rule.Emails) > 0 {
+		payload.Notifications.Email = &onekeV7AlertEmail{Recipients: rule.Emails}
+	}
+	for _, integration := range rule.Integrations {
+		payload.Notifications.ThirdParty = append(payload.Notifications.ThirdParty, onekeV7AlertIntegration{IntegrationID: integration.ID, IntegrationType: integration.Type})
+	}
+	return payload
+}
+
+func (a *v7API) ListAlertRules(ctx context.Context) ([]AlertRule, error) {
+
+	var results onekeV7AlertRuleList
+	if err := a.client.make1keJSONRequest(ctx, "GET", "/alerts/rules", nil, &results); err != nil {
+		return nil, err
+	}
+
+	rules := make([]AlertRule, 0, len(results.AlertRules))
+	for _, rule := range results.AlertRules {
+		rules = append(rules, rule.toAlertRule())
+	}
+	return rules, nil
+}
+
+func (a *v7API) CreateAlertRule(ctx context.Context, rule AlertRule) (AlertRule, error) {
+
+	var created onekeV7AlertRuleDetails
+	if err := a.client.make1keJSONRequest(ctx, "POST", "/alerts/rules", v7AlertRulePayload(rule), &created); err != nil {
+		return AlertRule{}, err
+	}
+
+	return created.toAlertRule(), nil
+}
+
+func (a *v7API) UpdateAlertRule(ctx context.Context, id string, rule AlertRule) (AlertRule, error) {
+
+	var updated onekeV7AlertRuleDetails
+	if err := a.client.make1keJSONRequest(ctx, "PUT", "/alerts/rules/"+url.PathEscape(id), v7AlertRulePayload(rule), &updated); err != nil {
+		return AlertRule{}, err
+	}
+
+	return updated.toAlertRule(), nil
+}
@@ -0,0 +1,46 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"oneke"
+)
+
+// Client is what Apply needs from ThousandEyes, *oneke.Client does it
+type Client interface {
+	CreateTest(ctx context.Context, spec oneke.TestSpec) (oneke.Test, error)
+	UpdateTest(ctx context.Context, existing oneke.Test, spec oneke.TestSpec) (oneke.Test, error)
+	DeleteTest(ctx context.Context, testType string, id string) error
+}
+
+// Result is how an action went, Err is nil for keeps and conflicts
+type Result struct {
+	Action Action
+	Err    error
+}
+
+// Apply carries out a plan in order. A failed action doesn't stop the rest, every action gets a Result.
+func Apply(ctx context.Context, plan Actions, client Client) []Result {
+
+	results := make([]Result, 0, len(plan))
+
+	for _, action := range plan {
+		var err error
+
+		switch action.Kind {
+		case Create:
+			_, err = client.CreateTest(ctx, action.Spec)
+		case Update:
+			_, err = client.UpdateTest(ctx, action.Test, action.Spec)
+		case Delete:
+			err = client.DeleteTest(ctx, action.Test.Type, action.Test.ID)
+		case Keep, Conflict:
+		default:
+			err = fmt.Errorf("reconcile: unknown action %q", action.Kind)
+		}
+
+		results = append(results, Result{Action: action, Err: err})
+	}
+
+	return results
+}
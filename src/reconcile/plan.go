@@ -0,0 +1,272 @@
+// Package reconcile works out what has to change in ThousandEyes to bring a stack's tests in line with
+// what its terraform state says it should have, and then makes those changes. Working it out (Plan) is kept
+// apart from doing it (Apply) so the decisions can be checked without talking to anything.
+package reconcile
+
+import (
+	"fmt"
+	"oneke"
+	"strings"
+)
+
+// DesiredTest is a test a stack should have, one per template per URL in its terraform state.
+//
+// ReadOnly tests are looked for but never created or changed, which is how stg and dev are handled for now.
+// Problem is set when the template couldn't be resolved (no agents, alert rules we couldn't provision...),
+// any existing test is kept as it is rather than mopped up.
+type DesiredTest struct {
+	Stack    string
+	Tier     string
+	URL      string
+	ID       string
+	Template oneke.TestTemplate
+	LabelIDs []string
+
+	ReadOnly bool
+	Problem  error
+}
+
+// Key is what the test is matched on, its type and target
+func (d DesiredTest) Key() string {
+	return oneke.TestKey(d.Template.Type, d.Template.Target(d.URL))
+}
+
+// Spec is the test as the template says it should look, labels included
+func (d DesiredTest) Spec() (oneke.TestSpec, error) {
+	name, err := oneke.NewTestName(d.Stack, d.ID, d.Template.Type, d.Template.Target(d.URL)).Build()
+	if err != nil {
+		return oneke.TestSpec{}, err
+	}
+	spec := d.Template.Spec(name, d.URL)
+	spec.LabelIDs = d.LabelIDs
+	return spec, nil
+}
+
+// Kind is what an Action does
+type Kind string
+
+// The things an Action can do
+const (
+	Create   Kind = "create"
+	Update   Kind = "update"
+	Delete   Kind = "delete"
+	Keep     Kind = "keep"
+	Conflict Kind = "conflict"
+)
+
+// Action is one change to make, or not make, and why. Desired is set for everything except deletes, Test
+// for everything except creates and keeps of tests that don't exist. Creates and updates carry the spec to
+// send, updates the diff that called for it too.
+type Action struct {
+	Kind    Kind
+	Key     string
+	Desired *DesiredTest
+	Test    oneke.Test
+	Spec    oneke.TestSpec
+	Diff    oneke.TestDiff
+	Reason  string
+}
+
+func (a Action) String() string {
+	if a.Test.ID != "" {
+		return fmt.Sprintf("%v %v (test %v) - %v", a.Kind, a.Key, a.Test.ID, a.Reason)
+	}
+	return fmt.Sprintf("%v %v - %v", a.Kind, a.Key, a.Reason)
+}
+
+// Actions is a plan, in the order Apply carries it out. Go won't let it share Plan's name.
+type Actions []Action
+
+// Of returns just the actions of one kind
+func (p Actions) Of(kind Kind) Actions {
+	var out Actions
+	for _, action := range p {
+		if action.Kind == kind {
+			out = append(out, action)
+		}
+	}
+	return out
+}
+
+// Changes reports whether the plan does anything besides keep
+func (p Actions) Changes() bool {
+	for _, action := range p {
+		if action.Kind != Keep && action.Kind != Conflict {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Actions) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan - Create: %v - Update: %v - Delete: %v - Keep: %v - Conflict: %v\n", len(p.Of(Create)), len(p.Of(Update)), len(p.Of(Delete)), len(p.Of(Keep)), len(p.Of(Conflict)))
+	for _, action := range p {
+		fmt.Fprintf(&b, "  %v\n", action)
+	}
+	return b.String()
+}
+
+// Plan compares the tests a stack should have with what's in ThousandEyes. actual is the whole account with
+// Ownership set on the stack's own tests (see Inventory.WithOwnership), so a test someone else made for the
+// same thing stops us creating a duplicate without us taking it over.
+//
+// For each desired test:
+//   - if an earlier one has the same Key it's a Conflict, two templates can't both own one test
+//   - one of ours is kept, or updated if its Details show it has drifted
+//   - failing that a test of anyone's is kept, and nothing is created
+//   - failing that it's created, unless it's ReadOnly
+//
+// Then any of ours that weren't matched, duplicates included, are deleted. Plan doesn't talk to
+// ThousandEyes, tests without Details can't be checked for drift so are kept.
+func Plan(desired []DesiredTest, actual *oneke.Inventory) Actions {
+
+	var plan Actions
+	matched := make(map[string]bool)
+	wanted := make(map[string]bool)
+	claimed := make(map[string]*DesiredTest)
+
+	for i := range desired {
+		d := &desired[i]
+		key := d.Key()
+		wanted[key] = true
+
+		if first, ok := claimed[key]; ok {
+			// both would Find the same test and fight over it every run
+			plan = append(plan, Action{Kind: Conflict, Key: key, Desired: d, Reason: fmt.Sprintf("template %v (ID %v) wants the same test as template %v (ID %v), only the first is planned", d.Template.Name, d.ID, first.Template.Name, first.ID)})
+			continue
+		}
+		claimed[key] = d
+
+		found := actual.Find(d.Template.Type, d.Template.Target(d.URL))
+		var owned []oneke.Test
+		for _, test := range found {
+			if test.Ownership != "" {
+				owned = append(owned, test)
+			}
+		}
+
+		if d.Problem != nil {
+			// we can't tell what the test should look like, so hang on to whatever's there
+			for _, test := range owned {
+				matched[test.ID] = true
+				plan = append(plan, Action{Kind: Keep, Key: key, Desired: d, Test: test, Reason: "template couldn't be resolved - " + d.Problem.Error()})
+			}
+			continue
+		}
+
+		switch {
+		case len(owned) > 0:
+			existing := owned[0]
+			matched[existing.ID] = true
+			plan = append(plan, planExisting(d, key, existing))
+
+		case len(found) > 0:
+			plan = append(plan, Action{Kind: Keep, Key: key, Desired: d, Test: found[0], Reason: "test exists but isn't " + d.Stack + "'s, leaving it alone"})
+
+		case d.ReadOnly:
+			plan = append(plan, Action{Kind: Keep, Key: key, Desired: d, Reason: "no test, but " + d.Tier + " tests aren't created"})
+
+		default:
+			spec, err := d.Spec()
+			if err != nil {
+				plan = append(plan, Action{Kind: Keep, Key: key, Desired: d, Reason: "no test, but can't build its spec - " + err.Error()})
+				continue
+			}
+			plan = append(plan, Action{Kind: Create, Key: key, Desired: d, Spec: spec, Reason: "no test for " + key})
+		}
+	}
+
+	// anything of ours left over isn't wanted any more, or is a second test for something we've already got
+	for _, test := range actual.All() {
+		if test.Ownership == "" || matched[test.ID] {
+			continue
+		}
+		key := oneke.TestKey(test.Type, test.Target())
+		reason := "not in terraform state (owned because " + test.Ownership + ")"
+		if wanted[key] {
+			reason = "duplicate of another test for " + key
+		}
+		plan = append(plan, Action{Kind: Delete, Key: key, Test: test, Reason: reason})
+	}
+
+	return plan
+}
+
+// planExisting decides whether one of the stack's own tests needs updating
+func planExisting(d *DesiredTest, key string, existing oneke.Test) Action {
+
+	keep := Action{Kind: Keep, Key: key, Desired: d, Test: existing}
+
+	if d.ReadOnly {
+		keep.Reason = d.Tier + " tests aren't checked for drift"
+		return keep
+	}
+	if existing.Details == nil {
+		keep.Reason = "details not loaded, can't check for drift"
+		return keep
+	}
+
+	want, err := d.Spec()
+	if err != nil {
+		keep.Reason = "can't build the test's spec - " + err.Error()
+		return keep
+	}
+	// labels someone else added stay, we only make sure ours are there
+	want.LabelIDs = union(existing.Details.LabelIDs, want.LabelIDs)
+
+	diff := oneke.DiffSpecs(*existing.Details, want)
+	if len(diff) == 0 {
+		keep.Reason = "matches template " + d.Template.Name
+		return keep
+	}
+
+	return Action{Kind: Update, Key: key, Desired: d, Test: existing, Spec: want, Diff: diff, Reason: "drifted from template " + d.Template.Name + " - " + diff.String()}
+}
+
+// NeedsDetails returns the tests Plan will want Details for to check drift, the stack's own tests matching
+// desired tests that aren't ReadOnly, so callers only fetch what's needed
+func NeedsDetails(desired []DesiredTest, actual *oneke.Inventory) []oneke.Test {
+
+	var tests []oneke.Test
+	seen := make(map[string]bool)
+	for _, d := range desired {
+		key := d.Key()
+		if seen[key] {
+			// a conflict, Plan won't look at it
+			continue
+		}
+		seen[key] = true
+		if d.ReadOnly || d.Problem != nil {
+			continue
+		}
+		for _, test := range actual.Find(d.Template.Type, d.Template.Target(d.URL)) {
+			// Plan only looks at the first of ours
+			if test.Ownership != "" {
+				if test.Details == nil {
+					tests = append(tests, test)
+				}
+				break
+			}
+		}
+	}
+	return tests
+}
+
+// union is a followed by anything in b it doesn't already have
+func union(a []string, b []string) []string {
+	out := append([]string(nil), a...)
+	for _, s := range b {
+		found := false
+		for _, have := range out {
+			if have == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, s)
+		}
+	}
+	return out
+}
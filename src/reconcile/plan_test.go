@@ -0,0 +1,282 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"oneke"
+	"strings"
+	"testing"
+)
+
+const stack = "abc"
+
+var standard = oneke.TestTemplate{Name: "standard", Type: oneke.TestTypeHTTPServer, Interval: 300}
+
+func desiredFor(url string) DesiredTest {
+	return DesiredTest{Stack: stack, Tier: "prod", URL: url, ID: "standard", Template: standard, LabelIDs: []string{"1"}}
+}
+
+// ours is a test named the way we name them, so the default ownership rules give it to stack
+func ours(id string, url string) oneke.Test {
+	name, err := oneke.NewTestName(stack, "standard", standard.Type, url).Build()
+	if err != nil {
+		panic(err)
+	}
+	return oneke.Test{ID: id, Name: name, Type: standard.Type, URL: url}
+}
+
+func theirs(id string, url string) oneke.Test {
+	return oneke.Test{ID: id, Name: "made by hand", Type: standard.Type, URL: url}
+}
+
+// matching is the details of a test that already looks the way d wants it to
+func matching(d DesiredTest) oneke.TestSpec {
+	spec, err := d.Spec()
+	if err != nil {
+		panic(err)
+	}
+	return spec
+}
+
+type step struct {
+	kind   Kind
+	testID string
+	reason string
+}
+
+func TestPlan(t *testing.T) {
+
+	const (
+		urlA = "https://a.abc.companycloud.com/login"
+		urlB = "https://b.abc.companycloud.com/login"
+	)
+
+	drifted := matching(desiredFor(urlA))
+	drifted.Interval = 60
+	drifted.LabelIDs = []string{"someone-elses"}
+
+	readOnly := desiredFor(urlA)
+	readOnly.Tier = "stg"
+	readOnly.ReadOnly = true
+
+	problem := desiredFor(urlA)
+	problem.Problem = errors.New("no agents")
+
+	// a second template of the same type wants the very same test
+	rival := desiredFor(urlA)
+	rival.Template = oneke.TestTemplate{Name: "rival", Type: oneke.TestTypeHTTPServer, Interval: 60}
+
+	tests := []struct {
+		name    string
+		desired []DesiredTest
+		actual  []oneke.Test
+		details map[string]oneke.TestSpec
+		want    []step
+	}{
+		{
+			name:    "missing test is created",
+			desired: []DesiredTest{desiredFor(urlA)},
+			want:    []step{{Create, "", "no test"}},
+		},
+		{
+			name:    "matching test is kept",
+			desired: []DesiredTest{desiredFor(urlA)},
+			actual:  []oneke.Test{ours("1", urlA)},
+			details: map[string]oneke.TestSpec{"1": matching(desiredFor(urlA))},
+			want:    []step{{Keep, "1", "matches template"}},
+		},
+		{
+			name:    "drifted test is updated",
+			desired: []DesiredTest{desiredFor(urlA)},
+			actual:  []oneke.Test{ours("1", urlA)},
+			details: map[string]oneke.TestSpec{"1": drifted},
+			want:    []step{{Update, "1", "interval"}},
+		},
+		{
+			name:    "test without details is kept",
+			desired: []DesiredTest{desiredFor(urlA)},
+			actual:  []oneke.Test{ours("1", urlA)},
+			want:    []step{{Keep, "1", "details not loaded"}},
+		},
+		{
+			name:    "someone else's test stops a create",
+			desired: []DesiredTest{desiredFor(urlA)},
+			actual:  []oneke.Test{theirs("1", urlA)},
+			want:    []step{{Keep, "1", "isn't abc's"}},
+		},
+		{
+			name:    "read only test isn't created",
+			desired: []DesiredTest{readOnly},
+			want:    []step{{Keep, "", "aren't created"}},
+		},
+		{
+			name:    "read only test isn't checked for drift",
+			desired: []DesiredTest{readOnly},
+			actual:  []oneke.Test{ours("1", urlA)},
+			details: map[string]oneke.TestSpec{"1": drifted},
+			want:    []step{{Keep, "1", "aren't checked for drift"}},
+		},
+		{
+			name:    "unresolved template keeps every existing test",
+			desired: []DesiredTest{problem},
+			actual:  []oneke.Test{ours("1", urlA), ours("2", urlA)},
+			want:    []step{{Keep, "1", "no agents"}, {Keep, "2", "no agents"}},
+		},
+		{
+			name:    "duplicate is deleted",
+			desired: []DesiredTest{desiredFor(urlA)},
+			actual:  []oneke.Test{ours("1", urlA), ours("2", urlA)},
+			details: map[string]oneke.TestSpec{"1": matching(desiredFor(urlA))},
+			want:    []step{{Keep, "1", "matches template"}, {Delete, "2", "duplicate"}},
+		},
+		{
+			name:    "test no longer in state is deleted",
+			desired: []DesiredTest{desiredFor(urlA)},
+			actual:  []oneke.Test{ours("1", urlA), ours("2", urlB), theirs("3", urlB)},
+			details: map[string]oneke.TestSpec{"1": matching(desiredFor(urlA))},
+			want:    []step{{Keep, "1", "matches template"}, {Delete, "2", "not in terraform state"}},
+		},
+		{
+			name:    "same test twice is created once",
+			desired: []DesiredTest{desiredFor(urlA), rival},
+			want:    []step{{Create, "", "no test"}, {Conflict, "", "only the first"}},
+		},
+		{
+			name:    "same test twice is only updated for the first",
+			desired: []DesiredTest{desiredFor(urlA), rival},
+			actual:  []oneke.Test{ours("1", urlA)},
+			details: map[string]oneke.TestSpec{"1": matching(desiredFor(urlA))},
+			want:    []step{{Keep, "1", "matches template"}, {Conflict, "", "only the first"}},
+		},
+		{
+			name:   "nothing desired deletes only our tests",
+			actual: []oneke.Test{ours("1", urlA), theirs("2", urlA), ours("3", urlB)},
+			want:   []step{{Delete, "1", "not in terraform state"}, {Delete, "3", "not in terraform state"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			actual := oneke.NewInventory(tt.actual...).WithOwnership(stack, nil)
+			for id, details := range tt.details {
+				actual.SetDetails(id, details)
+			}
+
+			plan := Plan(tt.desired, actual)
+
+			if len(plan) != len(tt.want) {
+				t.Fatalf("got %d actions, want %d:\n%v", len(plan), len(tt.want), plan)
+			}
+			for i, want := range tt.want {
+				got := plan[i]
+				if got.Kind != want.kind || got.Test.ID != want.testID || !strings.Contains(got.Reason, want.reason) {
+					t.Errorf("action %d is %v, want %v of test %q because %q", i, got, want.kind, want.testID, want.reason)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanSpecs(t *testing.T) {
+
+	const url = "https://a.abc.companycloud.com/login"
+
+	// creates carry the labels the caller worked out
+	plan := Plan([]DesiredTest{desiredFor(url)}, oneke.NewInventory())
+	if got := plan[0].Spec; got.Name == "" || !sameStrings(got.LabelIDs, []string{"1"}) {
+		t.Errorf("create spec is %+v, want it named and labelled 1", got)
+	}
+
+	// updates keep labels someone else added
+	details := matching(desiredFor(url))
+	details.Interval = 60
+	details.LabelIDs = []string{"someone-elses"}
+	actual := oneke.NewInventory(ours("1", url)).WithOwnership(stack, nil)
+	actual.SetDetails("1", details)
+
+	plan = Plan([]DesiredTest{desiredFor(url)}, actual)
+	if got := plan[0].Spec; got.Interval != 300 || !sameStrings(got.LabelIDs, []string{"someone-elses", "1"}) {
+		t.Errorf("update spec is %+v, want interval 300 and both labels", got)
+	}
+}
+
+func TestNeedsDetails(t *testing.T) {
+
+	const url = "https://a.abc.companycloud.com/login"
+
+	readOnly := desiredFor(url)
+	readOnly.ReadOnly = true
+
+	actual := oneke.NewInventory(theirs("1", url), ours("2", url), ours("3", url)).WithOwnership(stack, nil)
+
+	if got := NeedsDetails([]DesiredTest{desiredFor(url)}, actual); len(got) != 1 || got[0].ID != "2" {
+		t.Errorf("NeedsDetails = %v, want just the first of ours", got)
+	}
+	if got := NeedsDetails([]DesiredTest{readOnly}, actual); len(got) != 0 {
+		t.Errorf("NeedsDetails = %v, want nothing for read only tests", got)
+	}
+}
+
+type fakeClient struct {
+	calls []string
+	fail  map[string]bool
+}
+
+func (f *fakeClient) call(name string) error {
+	f.calls = append(f.calls, name)
+	if f.fail[name] {
+		return errors.New(name + " failed")
+	}
+	return nil
+}
+
+func (f *fakeClient) CreateTest(ctx context.Context, spec oneke.TestSpec) (oneke.Test, error) {
+	return oneke.Test{}, f.call("create " + spec.URL)
+}
+
+func (f *fakeClient) UpdateTest(ctx context.Context, existing oneke.Test, spec oneke.TestSpec) (oneke.Test, error) {
+	return existing, f.call("update " + existing.ID)
+}
+
+func (f *fakeClient) DeleteTest(ctx context.Context, testType string, id string) error {
+	return f.call("delete " + id)
+}
+
+func TestApply(t *testing.T) {
+
+	plan := Actions{
+		{Kind: Create, Spec: oneke.TestSpec{URL: "https://a"}},
+		{Kind: Update, Test: oneke.Test{ID: "1"}},
+		{Kind: Keep, Test: oneke.Test{ID: "2"}},
+		{Kind: Delete, Test: oneke.Test{ID: "3"}},
+	}
+	client := &fakeClient{fail: map[string]bool{"update 1": true}}
+
+	results := Apply(context.Background(), plan, client)
+
+	// a failure doesn't stop the rest, and keeps don't call anything
+	if want := []string{"create https://a", "update 1", "delete 3"}; !sameStrings(client.calls, want) {
+		t.Errorf("calls = %v, want %v", client.calls, want)
+	}
+	if len(results) != len(plan) {
+		t.Fatalf("got %d results, want %d", len(results), len(plan))
+	}
+	for i, result := range results {
+		if failed := result.Err != nil; failed != (i == 1) {
+			t.Errorf("result %d error = %v", i, result.Err)
+		}
+	}
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
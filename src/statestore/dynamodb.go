@@ -0,0 +1,162 @@
+package statestore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDBStore keeps records in a DynamoDB table with a string partition key called "stack". Saves are
+// conditional so two invocations racing on the same stack can't go backwards. Endpoint points it at
+// something DynamoDB compatible instead, DynamoDB Local for example.
+type DynamoDBStore struct {
+	Table    string
+	Region   string
+	Endpoint string
+
+	once sync.Once
+	svc  dynamodbiface.DynamoDBAPI
+}
+
+// NewDynamoDBStore builds a store backed by table in region
+func NewDynamoDBStore(table string, region string) *DynamoDBStore {
+	return &DynamoDBStore{Table: table, Region: region}
+}
+
+// WithClient swaps in a DynamoDB client, handy for stubbing it out
+func (s *DynamoDBStore) WithClient(svc dynamodbiface.DynamoDBAPI) *DynamoDBStore {
+	s.svc = svc
+	return s
+}
+
+func (s *DynamoDBStore) client() dynamodbiface.DynamoDBAPI {
+	// The DynamoDB client only gets built once, not on every call
+	s.once.Do(func() {
+		if s.svc == nil {
+			config := aws.NewConfig().WithRegion(s.Region)
+			if s.Endpoint != "" {
+				config = config.WithEndpoint(s.Endpoint)
+			}
+			s.svc = dynamodb.New(session.New(), config)
+		}
+	})
+	return s.svc
+}
+
+// Last implements Store
+func (s *DynamoDBStore) Last(ctx context.Context, stack string) (Record, bool, error) {
+
+	result, err := s.client().GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            map[string]*dynamodb.AttributeValue{"stack": {S: aws.String(stack)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Record{}, false, fmt.Errorf("statestore: unable to read %v from %v: %w", stack, s.Table, err)
+	}
+	if len(result.Item) == 0 {
+		return Record{}, false, nil
+	}
+
+	record := Record{Stack: stack}
+	if v := result.Item["key"]; v != nil && v.S != nil {
+		record.Key = *v.S
+	}
+	if v := result.Item["serial"]; v != nil && v.N != nil {
+		record.Serial, err = strconv.ParseInt(*v.N, 10, 64)
+		if err != nil {
+			return Record{}, false, fmt.Errorf("statestore: bad serial for %v in %v: %w", stack, s.Table, err)
+		}
+	}
+	if v := result.Item["lineage"]; v != nil && v.S != nil {
+		record.Lineage = *v.S
+	}
+	if v := result.Item["sequencer"]; v != nil && v.S != nil {
+		record.Sequencer = *v.S
+	}
+	if v := result.Item["deleted"]; v != nil && v.BOOL != nil {
+		record.Deleted = *v.BOOL
+	}
+	if v := result.Item["appliedAt"]; v != nil && v.S != nil {
+		record.AppliedAt, _ = time.Parse(time.RFC3339, *v.S)
+	}
+	return record, true, nil
+}
+
+// Save implements Store
+func (s *DynamoDBStore) Save(ctx context.Context, record Record) error {
+
+	item := map[string]*dynamodb.AttributeValue{
+		"stack":     {S: aws.String(record.Stack)},
+		"key":       {S: aws.String(record.Key)},
+		"serial":    {N: aws.String(strconv.FormatInt(record.Serial, 10))},
+		"lineage":   {S: aws.String(record.Lineage)},
+		"deleted":   {BOOL: aws.Bool(record.Deleted)},
+		"appliedAt": {S: aws.String(record.AppliedAt.UTC().Format(time.RFC3339))},
+	}
+	if record.Sequencer != "" {
+		// stored padded so DynamoDB can compare them as strings
+		item["sequencer"] = &dynamodb.AttributeValue{S: aws.String(paddedSequencer(record.Sequencer))}
+	}
+
+	input := &dynamodb.PutItemInput{TableName: aws.String(s.Table), Item: item}
+	if condition, names, values := saveCondition(record); condition != "" {
+		input.ConditionExpression = aws.String(condition)
+		input.ExpressionAttributeNames = names
+		input.ExpressionAttributeValues = values
+	}
+
+	_, err := s.client().PutItemWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrStale
+		}
+		return fmt.Errorf("statestore: unable to save %v to %v: %w", record.Stack, s.Table, err)
+	}
+	return nil
+}
+
+// saveCondition is Record.supersedes as a DynamoDB condition, empty when record always supersedes. Missing
+// attributes never compare equal or unequal in DynamoDB, hence the attribute_not_exists checks.
+func saveCondition(record Record) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+
+	names := map[string]*string{"#stack": aws.String("stack")}
+	values := make(map[string]*dynamodb.AttributeValue)
+
+	// what decides when the events can't be ordered
+	fallback := ""
+	if !record.Deleted {
+		fallback = "#lineage = :lineage AND #serial < :serial"
+		names["#lineage"] = aws.String("lineage")
+		names["#serial"] = aws.String("serial")
+		values[":lineage"] = &dynamodb.AttributeValue{S: aws.String(record.Lineage)}
+		values[":serial"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(record.Serial, 10))}
+	}
+
+	if record.Sequencer == "" {
+		if fallback == "" {
+			return "", nil, nil
+		}
+		return "attribute_not_exists(#stack) OR (" + fallback + ")", names, values
+	}
+
+	names["#key"] = aws.String("key")
+	names["#sequencer"] = aws.String("sequencer")
+	values[":key"] = &dynamodb.AttributeValue{S: aws.String(record.Key)}
+	values[":sequencer"] = &dynamodb.AttributeValue{S: aws.String(paddedSequencer(record.Sequencer))}
+
+	condition := "attribute_not_exists(#stack) OR (#key = :key AND #sequencer < :sequencer)"
+	unordered := "(attribute_not_exists(#key) OR #key <> :key OR attribute_not_exists(#sequencer))"
+	if fallback == "" {
+		return condition + " OR " + unordered, names, values
+	}
+	return condition + " OR (" + unordered + " AND " + fallback + ")", names, values
+}
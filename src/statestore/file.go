@@ -0,0 +1,99 @@
+package statestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps records in a JSON file, one object keyed by stack. It's only safe for one process at a
+// time, which suits running locally; in Lambda it only lasts as long as the container's /tmp does.
+type FileStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewFileStore builds a store backed by the file at path, which doesn't have to exist yet
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// Last implements Store
+func (s *FileStore) Last(ctx context.Context, stack string) (Record, bool, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.read()
+	if err != nil {
+		return Record{}, false, err
+	}
+	record, ok := records[stack]
+	return record, ok, nil
+}
+
+// Save implements Store
+func (s *FileStore) Save(ctx context.Context, record Record) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.read()
+	if err != nil {
+		return err
+	}
+	if last, ok := records[record.Stack]; ok && !record.supersedes(last) {
+		return ErrStale
+	}
+	records[record.Stack] = record
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("statestore: unable to encode %v: %w", s.Path, err)
+	}
+
+	// write alongside and rename so a crash part way through doesn't leave half a file
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("statestore: unable to write %v: %w", s.Path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("statestore: unable to write %v: %w", s.Path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("statestore: unable to write %v: %w", s.Path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("statestore: unable to write %v: %w", s.Path, err)
+	}
+	return nil
+}
+
+func (s *FileStore) read() (map[string]Record, error) {
+
+	records := make(map[string]Record)
+
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("statestore: unable to read %v: %w", s.Path, err)
+	}
+	if len(data) == 0 {
+		return records, nil
+	}
+
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("statestore: unable to parse %v: %w", s.Path, err)
+	}
+	return records, nil
+}
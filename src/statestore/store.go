@@ -0,0 +1,116 @@
+// Package statestore remembers the last terraform state applied for each stack, so a notification that
+// turns up late, twice or out of order doesn't put the stack's tests back to how an older state had them.
+package statestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrStale means a record wasn't saved because the store already has the same or a newer serial for the
+// stack, most likely written by another invocation in the meantime
+var ErrStale = errors.New("statestore: stack already has the same or a newer state")
+
+// Record is the terraform state last applied for a stack. Serial goes up every time terraform writes the
+// state, Lineage is fixed when the state is first created so a stack that was torn down and built again
+// starts a new one. Sequencer is the S3 sequencer of the event for Key, which is what orders events across
+// lineages - S3 only orders events on the same key, so records for different keys fall back to serials.
+// Deleted records are tombstones, left when the stack's state was removed.
+type Record struct {
+	Stack     string    `json:"stack"`
+	Key       string    `json:"key,omitempty"`
+	Serial    int64     `json:"serial"`
+	Lineage   string    `json:"lineage"`
+	Sequencer string    `json:"sequencer,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// Store keeps a Record per stack. Last returns false when the stack has never been recorded. Save returns
+// ErrStale rather than overwrite a record with one that doesn't supersede it.
+type Store interface {
+	Last(ctx context.Context, stack string) (Record, bool, error)
+	Save(ctx context.Context, record Record) error
+}
+
+// Check decides whether next, a state just read, should be applied given the last record for the stack.
+// When the two events can be ordered by sequencer anything older is skipped, a tombstone or a new lineage
+// gives way to anything newer, and otherwise the serial has to go up. When they can't be, a new lineage or
+// a deleted stack is skipped because there's no telling which came first. The reason says why either way,
+// for the logs.
+func Check(last Record, found bool, next Record) (bool, string) {
+
+	applied := last.AppliedAt.Format(time.RFC3339)
+
+	if !found {
+		return true, "no state applied before"
+	}
+
+	if ordered(last, next) {
+		switch {
+		case !laterSequencer(next.Sequencer, last.Sequencer):
+			return false, fmt.Sprintf("event %v isn't after %v, applied at %v", next.Sequencer, last.Sequencer, applied)
+		case last.Deleted:
+			return true, fmt.Sprintf("event %v is after the state was removed at %v", next.Sequencer, applied)
+		case next.Lineage != last.Lineage:
+			return true, fmt.Sprintf("new lineage %v, event %v is after %v", next.Lineage, next.Sequencer, last.Sequencer)
+		case next.Serial <= last.Serial:
+			return false, fmt.Sprintf("serial %d isn't newer than %d, applied at %v", next.Serial, last.Serial, applied)
+		}
+		return true, fmt.Sprintf("serial %d is newer than %d", next.Serial, last.Serial)
+	}
+
+	switch {
+	case last.Deleted:
+		return false, fmt.Sprintf("state was removed at %v and this event can't be ordered against it", applied)
+	case next.Lineage != last.Lineage:
+		return false, fmt.Sprintf("lineage %v isn't the last applied %v and this event can't be ordered against it", next.Lineage, last.Lineage)
+	case next.Serial > last.Serial:
+		return true, fmt.Sprintf("serial %d is newer than %d", next.Serial, last.Serial)
+	case next.Serial == last.Serial:
+		return false, fmt.Sprintf("serial %d was already applied at %v", next.Serial, applied)
+	}
+	return false, fmt.Sprintf("serial %d is older than %d, applied at %v", next.Serial, last.Serial, applied)
+}
+
+// supersedes reports whether r can replace last, the rule Save implementations follow. It only has to stop
+// two invocations racing each other backwards, Check has already decided r should be applied.
+func (r Record) supersedes(last Record) bool {
+	switch {
+	case ordered(r, last):
+		return laterSequencer(r.Sequencer, last.Sequencer)
+	case r.Deleted:
+		// the state has gone, whatever came before
+		return true
+	}
+	return r.Lineage == last.Lineage && r.Serial > last.Serial
+}
+
+// ordered reports whether two records' events can be ordered by their sequencers
+func ordered(a Record, b Record) bool {
+	return a.Key == b.Key && a.Sequencer != "" && b.Sequencer != ""
+}
+
+// sequencerWidth is what sequencers are padded to so they compare as strings, S3's are around 18 hex digits
+const sequencerWidth = 32
+
+// paddedSequencer left pads a sequencer with zeros so comparing strings compares the hex values
+func paddedSequencer(sequencer string) string {
+	sequencer = strings.ToUpper(sequencer)
+	if len(sequencer) >= sequencerWidth {
+		return sequencer
+	}
+	return strings.Repeat("0", sequencerWidth-len(sequencer)) + sequencer
+}
+
+// laterSequencer reports whether sequencer a is after b
+func laterSequencer(a string, b string) bool {
+	a, b = paddedSequencer(a), paddedSequencer(b)
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
@@ -0,0 +1,82 @@
+package statestore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+const key = "prod/us-west-2/abc/terraform.tfstate"
+
+func TestCheck(t *testing.T) {
+
+	applied := Record{Stack: "abc", Key: key, Serial: 5, Lineage: "old", Sequencer: "0055AED6DCD90281E5"}
+	tombstone := applied
+	tombstone.Sequencer = "0055AED6DCD90281E9"
+	tombstone.Deleted = true
+
+	tests := []struct {
+		name  string
+		last  Record
+		found bool
+		next  Record
+		apply bool
+	}{
+		{"first state", Record{}, false, Record{Serial: 1, Lineage: "old"}, true},
+		{"newer serial", applied, true, Record{Key: key, Serial: 6, Lineage: "old", Sequencer: "0055AED6DCD90281E6"}, true},
+		{"same serial again", applied, true, Record{Key: key, Serial: 5, Lineage: "old", Sequencer: "0055AED6DCD90281E6"}, false},
+		{"repeated event", applied, true, Record{Key: key, Serial: 6, Lineage: "old", Sequencer: applied.Sequencer}, false},
+		{"older event", applied, true, Record{Key: key, Serial: 6, Lineage: "old", Sequencer: "0055AED6DCD90281E0"}, false},
+		{"longer sequencer is later", applied, true, Record{Key: key, Serial: 6, Lineage: "old", Sequencer: "1055AED6DCD90281E5"}, true},
+		{"new lineage after", applied, true, Record{Key: key, Serial: 1, Lineage: "new", Sequencer: "0055AED6DCD90281E6"}, true},
+		{"old lineage after rebuild", Record{Key: key, Serial: 1, Lineage: "new", Sequencer: "0055AED6DCD90281E6"}, true, Record{Key: key, Serial: 5, Lineage: "old", Sequencer: applied.Sequencer}, false},
+		{"state before the tombstone", tombstone, true, Record{Key: key, Serial: 5, Lineage: "old", Sequencer: applied.Sequencer}, false},
+		{"state after the tombstone", tombstone, true, Record{Key: key, Serial: 1, Lineage: "new", Sequencer: "0055AED6DCD90281F0"}, true},
+		{"unordered newer serial", applied, true, Record{Key: "elsewhere", Serial: 6, Lineage: "old"}, true},
+		{"unordered new lineage", applied, true, Record{Key: "elsewhere", Serial: 1, Lineage: "new"}, false},
+		{"unordered after tombstone", tombstone, true, Record{Serial: 1, Lineage: "new"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apply, reason := Check(tt.last, tt.found, tt.next)
+			if apply != tt.apply {
+				t.Errorf("Check = %v (%v), want %v", apply, reason, tt.apply)
+			}
+		})
+	}
+}
+
+func TestFileStore(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewFileStore(filepath.Join(t.TempDir(), "serials.json"))
+
+	if _, found, err := s.Last(ctx, "abc"); found || err != nil {
+		t.Fatalf("Last on an empty store = %v, %v", found, err)
+	}
+
+	first := Record{Stack: "abc", Key: key, Serial: 5, Lineage: "old", Sequencer: "0055AED6DCD90281E5"}
+	if err := s.Save(ctx, first); err != nil {
+		t.Fatalf("Save = %v", err)
+	}
+
+	older := first
+	older.Sequencer = "0055AED6DCD90281E0"
+	if err := s.Save(ctx, older); !errors.Is(err, ErrStale) {
+		t.Errorf("Save of an older event = %v, want ErrStale", err)
+	}
+
+	tombstone := first
+	tombstone.Sequencer = "0055AED6DCD90281E9"
+	tombstone.Deleted = true
+	if err := s.Save(ctx, tombstone); err != nil {
+		t.Fatalf("Save of a tombstone = %v", err)
+	}
+
+	last, found, err := s.Last(ctx, "abc")
+	if !found || err != nil || last != tombstone {
+		t.Errorf("Last = %+v, %v, %v, want %+v", last, found, err, tombstone)
+	}
+}